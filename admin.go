@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dgryski/rgip/mlog"
+)
+
+// adminAuth wraps an admin handler, requiring the request to carry token as
+// a bearer token
+func adminAuth(token string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") || subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(token)) != 1 {
+			countError("admin", "unauthorized")
+			mlog.Println("unauthorized admin request from", r.RemoteAddr, ":", r.URL)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="rgip"`)
+			http.Error(w, "", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// ReloadResult is the response type for /admin/reload
+type ReloadResult struct {
+	OK         bool         `json:"ok"`
+	Error      string       `json:"error,omitempty"`
+	Generation uint64       `json:"generation"` // Generation is the generation serving lookups after the reload
+	Files      []fileResult `json:"files"`
+}
+
+// adminReloadHandler returns a handler which loads a new generation of the
+// data files named by config, responding once it's done
+func adminReloadHandler(config dataConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		Metrics.Requests.Add(1)
+
+		if r.Method != "POST" {
+			countError("admin_reload", "bad_method")
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "", http.StatusMethodNotAllowed)
+			return
+		}
+
+		mlog.Println("Attempting to reload data files: requested by", r.RemoteAddr)
+		results, err := loadDataFiles(config)
+
+		resp := ReloadResult{OK: err == nil, Files: results}
+		status := http.StatusOK
+		if err != nil {
+			mlog.Println("failed to load some data files, still serving the previous generation")
+			resp.Error = err.Error()
+			status = http.StatusInternalServerError
+		}
+
+		gen := acquireGeneration()
+		resp.Generation = gen.id
+		gen.setHeader(w)
+		gen.release()
+
+		w.Header().Set("Content-Type", contentTypeJSON)
+		w.WriteHeader(status)
+		encoder := json.NewEncoder(w)
+		encoder.Encode(resp)
+	}
+}
+
+// DataStatus is the response type for /admin/data
+type DataStatus struct {
+	Generation uint64     `json:"generation"`
+	Loaded     time.Time  `json:"loaded"`
+	Files      []dataFile `json:"files"`
+}
+
+func adminDataHandler(w http.ResponseWriter, r *http.Request) {
+
+	Metrics.Requests.Add(1)
+
+	gen := acquireGeneration()
+	defer gen.release()
+
+	resp := DataStatus{Generation: gen.id, Loaded: gen.loaded, Files: gen.files}
+	if resp.Files == nil {
+		resp.Files = []dataFile{}
+	}
+
+	gen.setHeader(w)
+	w.Header().Set("Content-Type", contentTypeJSON)
+	encoder := json.NewEncoder(w)
+	encoder.Encode(resp)
+}
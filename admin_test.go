@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestAdminAuth(t *testing.T) {
+	h := adminAuth("secret", func(w http.ResponseWriter, r *http.Request) {})
+
+	for _, tt := range []struct {
+		auth string
+		want int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"secret", http.StatusUnauthorized},
+		{"Bearer secret", http.StatusOK},
+	} {
+		req := httptest.NewRequest("GET", "/admin/data", nil)
+		if tt.auth != "" {
+			req.Header.Set("Authorization", tt.auth)
+		}
+		w := httptest.NewRecorder()
+		h(w, req)
+		if w.Code != tt.want {
+			t.Errorf("Authorization %q: status %d, want %d", tt.auth, w.Code, tt.want)
+		}
+	}
+}
+
+func TestAdminReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rgipData")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	h := adminReloadHandler(dataConfig{Lite: true, DataDir: dir})
+
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/admin/reload", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET status %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+
+	w = httptest.NewRecorder()
+	h(w, httptest.NewRequest("POST", "/admin/reload", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+
+	var resp ReloadResult
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.OK || len(resp.Files) != 1 || resp.Files[0].OK {
+		t.Errorf("response %+v, want one failed file", resp)
+	}
+}
+
+func TestAdminData(t *testing.T) {
+	gen := &generation{files: []dataFile{{Path: "ufi.bin", Size: 100, Records: 3}}}
+	swapGeneration(gen)
+
+	w := httptest.NewRecorder()
+	adminDataHandler(w, httptest.NewRequest("GET", "/admin/data", nil))
+
+	var resp DataStatus
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Generation != gen.id || len(resp.Files) != 1 || resp.Files[0].Records != 3 {
+		t.Errorf("response %+v, want generation %d with ufi.bin", resp, gen.id)
+	}
+	if h := w.Header().Get("X-Rgip-Generation"); h == "" {
+		t.Errorf("missing generation header")
+	}
+}
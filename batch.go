@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/dgryski/rgip/mlog"
+)
+
+// maxBatch is the most addresses accepted in a POST to /lookups
+var maxBatch = 1000
+
+// maxBatchLineLen bounds the bytes per address in a batch request body,
+// allowing for an IPv6 address plus quoting and whitespace
+const maxBatchLineLen = 64
+
+var errBatchTooLarge = errors.New("batch too large")
+
+// readBatch reads a JSON array of addresses, or one address per line,
+// returning errBatchTooLarge if there are more than max
+func readBatch(r io.Reader, max int) ([]string, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(r, int64(max)*maxBatchLineLen+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > max*maxBatchLineLen {
+		return nil, errBatchTooLarge
+	}
+
+	var ips []string
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &ips); err != nil {
+			return nil, err
+		}
+	} else {
+		scanner := bufio.NewScanner(bytes.NewReader(body))
+		for scanner.Scan() {
+			if ip := strings.TrimSpace(scanner.Text()); ip != "" {
+				ips = append(ips, ip)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(ips) > max {
+		return nil, errBatchTooLarge
+	}
+
+	return ips, nil
+}
+
+// lookupsPostHandler looks up a batch of addresses from the request body,
+// responding with their results in the same order.  Each result's
+// ip_status is OK or ParseError.
+func lookupsPostHandler(w http.ResponseWriter, r *http.Request) {
+
+	Metrics.Requests.Add(1)
+
+	if r.Method != "POST" {
+		countError("lookups_post", "bad_method")
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	fields, err := requestFields(r)
+	if err != nil {
+		countError("lookups_post", "bad_fields")
+		mlog.Println("error parsing fields:", r.URL, ":", err)
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	ips, err := readBatch(r.Body, maxBatch)
+	if err == errBatchTooLarge {
+		countError("lookups_post", "batch_too_large")
+		mlog.Println("batch from", r.RemoteAddr, "exceeds", maxBatch, "addresses")
+		http.Error(w, "", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		countError("lookups_post", "bad_body")
+		mlog.Println("error reading batch:", err)
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	prom.batchSize.observe(float64(len(ips)), "lookups_post")
+
+	gen := acquireGeneration()
+	defer gen.release()
+
+	ipinfos := make([]interface{}, len(ips))
+	for i, ip := range ips {
+		ipinfo, err := gen.lookupIPInfoFields(ip, fields)
+		if err != nil {
+			countError("lookups_post", "parse_error")
+			mlog.Println("error during lookup:", ip, ":", err)
+			ipinfo = IPInfo{IP: ip, IPStatus: "ParseError"}
+		} else {
+			ipinfo.IPStatus = "OK"
+		}
+		ipinfos[i] = ipinfo.selectFields(fields)
+	}
+
+	gen.setHeader(w)
+	w.Header().Set("Content-Type", contentTypeJSON)
+	encoder := json.NewEncoder(w)
+	encoder.Encode(ipinfos)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadBatch(t *testing.T) {
+	for _, tt := range []struct {
+		body string
+		want []string
+	}{
+		{`["1.2.3.4", "::1", "1.2.3.4"]`, []string{"1.2.3.4", "::1", "1.2.3.4"}},
+		{"1.2.3.4\n\n  ::1\r\n1.2.3.4", []string{"1.2.3.4", "::1", "1.2.3.4"}},
+		{"", nil},
+	} {
+		got, err := readBatch(strings.NewReader(tt.body), 3)
+		if err != nil {
+			t.Errorf("readBatch(%q): %s", tt.body, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("readBatch(%q)=%q, want %q", tt.body, got, tt.want)
+		}
+	}
+
+	if _, err := readBatch(strings.NewReader("1.1.1.1\n2.2.2.2\n3.3.3.3\n4.4.4.4\n"), 3); err != errBatchTooLarge {
+		t.Errorf("expected errBatchTooLarge for 4 lines, got %v", err)
+	}
+	if _, err := readBatch(strings.NewReader(strings.Repeat(" ", 3*maxBatchLineLen+1)), 3); err != errBatchTooLarge {
+		t.Errorf("expected errBatchTooLarge for long body, got %v", err)
+	}
+	if _, err := readBatch(strings.NewReader(`["1.2.3.4"`), 3); err == nil {
+		t.Errorf("expected error for bad JSON")
+	}
+}
+
+func TestLookupsPostHandler(t *testing.T) {
+	swapGeneration(testGeneration())
+
+	w := httptest.NewRecorder()
+	lookupsPostHandler(w, httptest.NewRequest("POST", "/lookups", strings.NewReader(`["1.2.3.4", "bogus", "1.2.3.4"]`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d, want %d", w.Code, http.StatusOK)
+	}
+
+	var results []IPInfo
+	if err := json.NewDecoder(w.Body).Decode(&results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("got %d results, want 3", len(results))
+	}
+	for i, want := range []struct {
+		ip, status string
+		ufi        int32
+	}{
+		{"1.2.3.4", "OK", 7},
+		{"bogus", "ParseError", 0},
+		{"1.2.3.4", "OK", 7},
+	} {
+		if r := results[i]; r.IP != want.ip || r.IPStatus != want.status || r.UFI.GuessedUFI != want.ufi {
+			t.Errorf("result %d=%+v, want %+v", i, r, want)
+		}
+	}
+
+	defer func(n int) { maxBatch = n }(maxBatch)
+	maxBatch = 2
+	w = httptest.NewRecorder()
+	lookupsPostHandler(w, httptest.NewRequest("POST", "/lookups", strings.NewReader("1.1.1.1\n2.2.2.2\n3.3.3.3\n")))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status %d, want %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+}
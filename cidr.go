@@ -0,0 +1,55 @@
+package main
+
+import "net"
+
+// splitRange calls fn with each of the prefixes in the minimal set of CIDR
+// prefixes covering from-to.  Addresses are width bits wide, which must be 32
+// for IPv4 or 128 for IPv6.
+func splitRange(from, to uint128, width int, fn func(ip uint128, prefixLen int)) {
+	for {
+		// the largest aligned block starting at from that doesn't pass to
+		size := from.trailingZeros()
+		if size > width {
+			size = width
+		}
+		for to.less(from.or(ones(size))) {
+			size--
+		}
+
+		fn(from, width-size)
+
+		last := from.or(ones(size))
+		if !last.less(to) {
+			return
+		}
+		from = last.incr()
+	}
+}
+
+// cidrs returns the minimal set of CIDR prefixes covering the range
+func (r ipRange) cidrs() []*net.IPNet {
+	var nets []*net.IPNet
+	splitRange(uint128{0, uint64(r.rangeFrom)}, uint128{0, uint64(r.rangeTo)}, 32, func(ip uint128, prefixLen int) {
+		nets = append(nets, &net.IPNet{IP: uint32ToIP(uint32(ip.lo)), Mask: net.CIDRMask(prefixLen, 32)})
+	})
+	return nets
+}
+
+// cidrs returns the minimal set of CIDR prefixes covering the range
+func (r ipRange6) cidrs() []*net.IPNet {
+	var nets []*net.IPNet
+	splitRange(r.rangeFrom, r.rangeTo, 128, func(ip uint128, prefixLen int) {
+		nets = append(nets, &net.IPNet{IP: ip.IP(), Mask: net.CIDRMask(prefixLen, 128)})
+	})
+	return nets
+}
+
+// netRange returns the first and last addresses of n
+func netRange(n *net.IPNet) (net.IP, net.IP) {
+	from := n.IP.Mask(n.Mask)
+	to := make(net.IP, len(from))
+	for i := range from {
+		to[i] = from[i] | ^n.Mask[len(n.Mask)-len(from)+i]
+	}
+	return from, to
+}
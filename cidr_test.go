@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+func TestCIDRs(t *testing.T) {
+	tests := []struct {
+		r    ipRange
+		want []string
+	}{
+		{ipRange{0x01000000, 0x010000ff, 0}, []string{"1.0.0.0/24"}},
+		{ipRange{0x01000001, 0x01000006, 0}, []string{"1.0.0.1/32", "1.0.0.2/31", "1.0.0.4/31", "1.0.0.6/32"}},
+		{ipRange{0, 0xffffffff, 0}, []string{"0.0.0.0/0"}},
+		{ipRange{0xfffffffe, 0xffffffff, 0}, []string{"255.255.255.254/31"}},
+	}
+
+	for _, tt := range tests {
+		var got []string
+		for _, n := range tt.r.cidrs() {
+			got = append(got, n.String())
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%v.cidrs()=%v, want %v", tt.r, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%v.cidrs()=%v, want %v", tt.r, got, tt.want)
+				break
+			}
+		}
+	}
+
+	r6 := ipRange6{uint128{0x20010db8 << 32, 0}, uint128{0x20010db8 << 32, 1 << 32}, 0}
+	var got []string
+	for _, n := range r6.cidrs() {
+		got = append(got, n.String())
+	}
+	if want := []string{"2001:db8::/96", "2001:db8::1:0:0/128"}; len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("cidrs()=%v, want %v", got, want)
+	}
+
+	all := ipRange6{uint128{}, uint128{^uint64(0), ^uint64(0)}, 0}
+	if got := all.cidrs(); len(got) != 1 || got[0].String() != "::/0" {
+		t.Errorf("cidrs()=%v, want ::/0", got)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// trustedProxies are the networks of proxies whose forwarding headers are
+// believed when finding the client address for /lookup/me
+var trustedProxies []*net.IPNet
+
+// parseTrustedProxies parses a comma-separated list of CIDRs.  A bare
+// address is taken as a network of one.
+func parseTrustedProxies(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, c := range strings.Split(s, ",") {
+		c = strings.TrimSpace(c)
+		if !strings.Contains(c, "/") {
+			ip := net.ParseIP(c)
+			if ip == nil {
+				return nil, fmt.Errorf("bad proxy address %q", c)
+			}
+			bits := 128
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("bad proxy network %q: %s", c, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func isTrusted(ip net.IP, trusted []*net.IPNet) bool {
+	for _, n := range trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedFor returns the for= addresses of Forwarded headers, nearest hop last
+func forwardedFor(values []string) []string {
+	var addrs []string
+	for _, v := range values {
+		for _, elem := range strings.Split(v, ",") {
+			for _, pair := range strings.Split(elem, ";") {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+					addrs = append(addrs, strings.Trim(kv[1], `"`))
+				}
+			}
+		}
+	}
+	return addrs
+}
+
+// parseHop parses a forwarded address, which may have a port, and for IPv6
+// with a port, brackets
+func parseHop(s string) net.IP {
+	s = strings.TrimSpace(s)
+	if ip := net.ParseIP(s); ip != nil {
+		return ip
+	}
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		return net.ParseIP(host)
+	}
+	if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+		return net.ParseIP(s[1 : len(s)-1])
+	}
+	return nil
+}
+
+// clientIP returns the address of the client making r.  If the peer is a
+// trusted proxy, the addresses it forwarded in Forwarded, X-Forwarded-For or
+// X-Real-IP are walked from the nearest hop outwards, stopping at the first
+// which isn't a trusted proxy or can't be parsed.
+func clientIP(r *http.Request, trusted []*net.IPNet) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !isTrusted(ip, trusted) {
+		return host
+	}
+
+	var hops []string
+	switch {
+	case len(r.Header["Forwarded"]) > 0:
+		hops = forwardedFor(r.Header["Forwarded"])
+	case len(r.Header["X-Forwarded-For"]) > 0:
+		for _, v := range r.Header["X-Forwarded-For"] {
+			hops = append(hops, strings.Split(v, ",")...)
+		}
+	case r.Header.Get("X-Real-IP") != "":
+		hops = []string{r.Header.Get("X-Real-IP")}
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := parseHop(hops[i])
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !isTrusted(ip, trusted) {
+			break
+		}
+	}
+
+	return ip.String()
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	nets, err := parseTrustedProxies("10.0.0.0/8, 192.0.2.1,2001:db8::/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"10.0.0.0/8", "192.0.2.1/32", "2001:db8::/32"}
+	if len(nets) != len(want) {
+		t.Fatalf("got %d networks, want %d", len(nets), len(want))
+	}
+	for i, n := range nets {
+		if n.String() != want[i] {
+			t.Errorf("network %d=%s, want %s", i, n, want[i])
+		}
+	}
+
+	for _, s := range []string{"10.0.0.0/33", "bogus", ""} {
+		if _, err := parseTrustedProxies(s); err == nil {
+			t.Errorf("parseTrustedProxies(%q): expected error", s)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	trusted, _ := parseTrustedProxies("10.0.0.0/8,::1")
+
+	for _, tt := range []struct {
+		remote  string
+		headers map[string]string
+		want    string
+	}{
+		{"203.0.113.9:1234", nil, "203.0.113.9"},
+		// untrusted peers can't set the address
+		{"203.0.113.9:1234", map[string]string{"X-Forwarded-For": "1.2.3.4"}, "203.0.113.9"},
+		{"10.1.1.1:1234", map[string]string{"X-Forwarded-For": "1.2.3.4"}, "1.2.3.4"},
+		// an address spoofed by the client before the trusted proxies is ignored
+		{"10.1.1.1:1234", map[string]string{"X-Forwarded-For": "6.6.6.6, 1.2.3.4,10.2.2.2"}, "1.2.3.4"},
+		{"10.1.1.1:1234", map[string]string{"X-Forwarded-For": "10.3.3.3, 10.2.2.2"}, "10.3.3.3"},
+		{"10.1.1.1:1234", map[string]string{"X-Forwarded-For": "1.2.3.4, unknown"}, "10.1.1.1"},
+		{"10.1.1.1:1234", map[string]string{"X-Real-IP": "1.2.3.4"}, "1.2.3.4"},
+		{"[::1]:1234", map[string]string{"Forwarded": `for=1.2.3.4;proto=https, for="[2001:db8::1]:4711";by=10.0.0.1`}, "2001:db8::1"},
+		{"10.1.1.1:1234", map[string]string{"Forwarded": "for=1.2.3.4:80", "X-Forwarded-For": "5.6.7.8"}, "1.2.3.4"},
+		{"10.1.1.1:1234", nil, "10.1.1.1"},
+	} {
+		r := httptest.NewRequest("GET", "/lookup/me", nil)
+		r.RemoteAddr = tt.remote
+		for k, v := range tt.headers {
+			r.Header.Set(k, v)
+		}
+		if got := clientIP(r, trusted); got != tt.want {
+			t.Errorf("clientIP(%s, %v)=%s, want %s", tt.remote, tt.headers, got, tt.want)
+		}
+	}
+}
+
+func TestLookupMe(t *testing.T) {
+	swapGeneration(testGeneration())
+
+	defer func(nets []*net.IPNet) { trustedProxies = nets }(trustedProxies)
+	trustedProxies, _ = parseTrustedProxies("10.0.0.0/8")
+
+	for _, path := range []string{"/lookup/me", "/lookup/"} {
+		r := httptest.NewRequest("GET", path, nil)
+		r.RemoteAddr = "10.1.1.1:1234"
+		r.Header.Set("X-Forwarded-For", "1.2.3.4")
+		w := httptest.NewRecorder()
+		lookupHandler(w, r)
+
+		var ipinfo IPInfo
+		if err := json.NewDecoder(w.Body).Decode(&ipinfo); err != nil {
+			t.Fatalf("%s: %s", path, err)
+		}
+		if ipinfo.IP != "1.2.3.4" || ipinfo.UFI.GuessedUFI != 7 {
+			t.Errorf("%s=%+v, want 1.2.3.4 with UFI 7", path, ipinfo)
+		}
+		if cc := w.Header().Get("Cache-Control"); cc != "private" {
+			t.Errorf("%s: Cache-Control %q", path, cc)
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"sort"
+)
+
+// span is a range of either address family, with IPv4 addresses in the low 32 bits
+type span struct {
+	from, to uint128
+	data     int32
+}
+
+// spans4 returns the IPv4 ranges as spans holding their UFI
+func spans4(r ipRangeList, t valueTable) []span {
+	s := make([]span, len(r))
+	for i, v := range r {
+		s[i] = span{uint128{0, uint64(v.rangeFrom)}, uint128{0, uint64(v.rangeTo)}, t.get(v.data).UFI}
+	}
+	return s
+}
+
+// spans6 returns the IPv6 ranges as spans holding their UFI
+func spans6(r ipRange6List, t valueTable) []span {
+	s := make([]span, len(r))
+	for i, v := range r {
+		s[i] = span{v.rangeFrom, v.rangeTo, t.get(v.data).UFI}
+	}
+	return s
+}
+
+// diffSpans walks two sorted, non-overlapping span lists in step, calling fn
+// with each stretch of address space covered by either list.  inA and inB
+// report whether the stretch is covered by a and b, with their values in
+// dataA and dataB.
+func diffSpans(a, b []span, fn func(from, to uint128, dataA, dataB int32, inA, inB bool)) {
+	var i, j int
+	var pos uint128
+	for {
+		for i < len(a) && a[i].to.less(pos) {
+			i++
+		}
+		for j < len(b) && b[j].to.less(pos) {
+			j++
+		}
+		if i == len(a) && j == len(b) {
+			return
+		}
+
+		inA := i < len(a) && a[i].from.lessEq(pos)
+		inB := j < len(b) && b[j].from.lessEq(pos)
+
+		if !inA && !inB {
+			// skip to the next range to start
+			switch {
+			case i == len(a):
+				pos = b[j].from
+			case j == len(b):
+				pos = a[i].from
+			case a[i].from.less(b[j].from):
+				pos = a[i].from
+			default:
+				pos = b[j].from
+			}
+			continue
+		}
+
+		// the stretch ends where either list next changes
+		end := ones(128)
+		var dataA, dataB int32
+		if inA {
+			end, dataA = a[i].to, a[i].data
+		} else if i < len(a) && a[i].from.decr().less(end) {
+			end = a[i].from.decr()
+		}
+		if inB {
+			dataB = b[j].data
+			if b[j].to.less(end) {
+				end = b[j].to
+			}
+		} else if j < len(b) && b[j].from.decr().less(end) {
+			end = b[j].from.decr()
+		}
+
+		fn(pos, end, dataA, dataB, inA, inB)
+
+		if end == ones(128) {
+			return
+		}
+		pos = end.incr()
+	}
+}
+
+// rangeDiff is a stretch of address space whose value differs between two datasets
+type rangeDiff struct {
+	Start  string `json:"start"`
+	End    string `json:"end"`
+	Change string `json:"change"` // Change is one of changed, added or removed
+	OldUFI *int32 `json:"old_ufi,omitempty"`
+	NewUFI *int32 `json:"new_ufi,omitempty"`
+}
+
+// diffCounts are the number of addresses changed, added and removed
+type diffCounts struct {
+	Changed *big.Int `json:"changed"`
+	Added   *big.Int `json:"added"`
+	Removed *big.Int `json:"removed"`
+}
+
+func newDiffCounts() *diffCounts {
+	return &diffCounts{new(big.Int), new(big.Int), new(big.Int)}
+}
+
+// ufiCounts are the number of addresses a UFI gained and lost
+type ufiCounts struct {
+	UFI    int32    `json:"ufi"`
+	Gained *big.Int `json:"gained"`
+	Lost   *big.Int `json:"lost"`
+}
+
+type blockCounts struct {
+	Block string `json:"block"`
+	*diffCounts
+}
+
+// diffReport is the result of comparing two range datasets
+type diffReport struct {
+	Old     string        `json:"old"`
+	New     string        `json:"new"`
+	Summary *diffCounts   `json:"summary"`
+	ByUFI   []ufiCounts   `json:"by_ufi"`
+	ByBlock []blockCounts `json:"by_block"`
+	Ranges  []rangeDiff   `json:"ranges,omitempty"`
+
+	ufis   map[int32]*ufiCounts
+	blocks map[string]*diffCounts
+}
+
+func (d *diffReport) ufi(ufi int32) *ufiCounts {
+	c, ok := d.ufis[ufi]
+	if !ok {
+		c = &ufiCounts{UFI: ufi, Gained: new(big.Int), Lost: new(big.Int)}
+		d.ufis[ufi] = c
+	}
+	return c
+}
+
+func (d *diffReport) block(block string) *diffCounts {
+	c, ok := d.blocks[block]
+	if !ok {
+		c = newDiffCounts()
+		d.blocks[block] = c
+	}
+	return c
+}
+
+// add records a stretch of address space that differs.  Addresses are width
+// bits wide, and blocks are the top blockBits of the address.
+func (d *diffReport) add(a, b []span, width, blockBits int, withRanges bool) {
+	ip := func(u uint128) net.IP {
+		if width == 32 {
+			return uint32ToIP(uint32(u.lo))
+		}
+		return u.IP()
+	}
+
+	diffSpans(a, b, func(from, to uint128, oldUFI, newUFI int32, inOld, inNew bool) {
+		if inOld && inNew && oldUFI == newUFI {
+			return
+		}
+
+		size := rangeSize(from, to)
+		var change string
+		switch {
+		case inOld && inNew:
+			change = "changed"
+			d.Summary.Changed.Add(d.Summary.Changed, size)
+		case inNew:
+			change = "added"
+			d.Summary.Added.Add(d.Summary.Added, size)
+		default:
+			change = "removed"
+			d.Summary.Removed.Add(d.Summary.Removed, size)
+		}
+
+		if inOld {
+			c := d.ufi(oldUFI)
+			c.Lost.Add(c.Lost, size)
+		}
+		if inNew {
+			c := d.ufi(newUFI)
+			c.Gained.Add(c.Gained, size)
+		}
+
+		// attribute the stretch to each block it touches
+		blockSize := width - blockBits
+		for f := from; ; {
+			t := f.or(ones(blockSize))
+			if to.less(t) {
+				t = to
+			}
+			n := rangeSize(f, t)
+			block := d.block(fmt.Sprintf("%s/%d", ip(f).Mask(net.CIDRMask(blockBits, width)), blockBits))
+			switch change {
+			case "changed":
+				block.Changed.Add(block.Changed, n)
+			case "added":
+				block.Added.Add(block.Added, n)
+			case "removed":
+				block.Removed.Add(block.Removed, n)
+			}
+			if t == to {
+				break
+			}
+			f = t.incr()
+		}
+
+		if withRanges {
+			r := rangeDiff{Start: ip(from).String(), End: ip(to).String(), Change: change}
+			if inOld {
+				r.OldUFI = &oldUFI
+			}
+			if inNew {
+				r.NewUFI = &newUFI
+			}
+			d.Ranges = append(d.Ranges, r)
+		}
+	})
+}
+
+// diffRanges compares two datasets.  IPv4 changes are aggregated by /8 and
+// IPv6 changes by /16.
+func diffRanges(oldName string, oldSet rangeSet, newName string, newSet rangeSet, withRanges bool) *diffReport {
+	d := &diffReport{
+		Old:     oldName,
+		New:     newName,
+		Summary: newDiffCounts(),
+		ufis:    make(map[int32]*ufiCounts),
+		blocks:  make(map[string]*diffCounts),
+	}
+
+	d.add(spans4(oldSet.v4, oldSet.table), spans4(newSet.v4, newSet.table), 32, 8, withRanges)
+	d.add(spans6(oldSet.v6, oldSet.table), spans6(newSet.v6, newSet.table), 128, 16, withRanges)
+
+	for _, c := range d.ufis {
+		d.ByUFI = append(d.ByUFI, *c)
+	}
+	sort.Slice(d.ByUFI, func(i, j int) bool { return d.ByUFI[i].UFI < d.ByUFI[j].UFI })
+
+	for b, c := range d.blocks {
+		d.ByBlock = append(d.ByBlock, blockCounts{Block: b, diffCounts: c})
+	}
+	sort.Slice(d.ByBlock, func(i, j int) bool {
+		bi, _, _ := net.ParseCIDR(d.ByBlock[i].Block)
+		bj, _, _ := net.ParseCIDR(d.ByBlock[j].Block)
+		if len(bi.To4()) != len(bj.To4()) {
+			return bi.To4() != nil
+		}
+		return compareIP(bi.To16(), bj.To16()) < 0
+	})
+
+	return d
+}
+
+// diffMain implements the diff command, printing the differences between two
+// range datasets as JSON
+func diffMain(args []string) int {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	withRanges := fs.Bool("ranges", false, "list every range that differs, not just the totals")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: rgip diff [-ranges] old new")
+		fmt.Fprintln(os.Stderr, "old and new may be CSV, rgipMap binary or mmdb files")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return 2
+	}
+
+	var sets [2]rangeSet
+	for i, fname := range fs.Args() {
+		var err error
+		sets[i], err = loadRangeFile(fname)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to load %s: %s\n", fname, err)
+			return 1
+		}
+	}
+
+	d := diffRanges(fs.Arg(0), sets[0], fs.Arg(1), sets[1], *withRanges)
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(d); err != nil {
+		fmt.Fprintln(os.Stderr, "error writing diff:", err)
+		return 1
+	}
+
+	return 0
+}
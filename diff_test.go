@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestDiffRanges(t *testing.T) {
+	oldSet := rangeSet{
+		v4: ipRangeList{
+			{0x01000000, 0x010000ff, 100},
+			{0x01000100, 0x010001ff, 101},
+			{0x02000000, 0x020000ff, 102},
+		},
+		v6: ipRange6List{
+			{uint128{0x20010db8 << 32, 0}, uint128{0x20010db8 << 32, 0xff}, 200},
+		},
+	}
+
+	newSet := rangeSet{
+		v4: ipRangeList{
+			{0x01000000, 0x0100007f, 100},
+			{0x01000080, 0x010001ff, 101}, // 1.0.0.128/25 changed from 100 to 101
+			{0x01ffff00, 0x020000ff, 103}, // 1.255.255.0/24 added, 2.0.0.0/24 changed
+		},
+		v6: ipRange6List{
+			{uint128{0x20010db8 << 32, 0}, uint128{0x20010db8 << 32, 0xff}, 200},
+		},
+	}
+
+	d := diffRanges("old", oldSet, "new", newSet, true)
+
+	got, err := json.Marshal(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var report struct {
+		Summary map[string]int
+		ByUFI   []map[string]int `json:"by_ufi"`
+		ByBlock []struct {
+			Block                   string
+			Changed, Added, Removed int
+		} `json:"by_block"`
+		Ranges []map[string]interface{}
+	}
+	if err := json.Unmarshal(got, &report); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := map[string]int{"changed": 128 + 256, "added": 256, "removed": 0}; !reflect.DeepEqual(report.Summary, want) {
+		t.Errorf("summary=%v, want %v", report.Summary, want)
+	}
+
+	wantUFIs := []map[string]int{
+		{"ufi": 100, "gained": 0, "lost": 128},
+		{"ufi": 101, "gained": 128, "lost": 0},
+		{"ufi": 102, "gained": 0, "lost": 256},
+		{"ufi": 103, "gained": 512, "lost": 0},
+	}
+	if !reflect.DeepEqual(report.ByUFI, wantUFIs) {
+		t.Errorf("by_ufi=%v, want %v", report.ByUFI, wantUFIs)
+	}
+
+	if len(report.ByBlock) != 2 || report.ByBlock[0].Block != "1.0.0.0/8" || report.ByBlock[0].Changed != 128 || report.ByBlock[0].Added != 256 ||
+		report.ByBlock[1].Block != "2.0.0.0/8" || report.ByBlock[1].Changed != 256 {
+		t.Errorf("by_block=%+v", report.ByBlock)
+	}
+
+	if len(report.Ranges) != 3 || report.Ranges[0]["start"] != "1.0.0.128" || report.Ranges[1]["change"] != "added" || report.Ranges[2]["end"] != "2.0.0.255" {
+		t.Errorf("ranges=%v", report.Ranges)
+	}
+
+	same := diffRanges("old", oldSet, "old", oldSet, true)
+	if same.Summary.Changed.Sign() != 0 || same.Summary.Added.Sign() != 0 || same.Summary.Removed.Sign() != 0 || len(same.Ranges) != 0 {
+		t.Errorf("unexpected differences %+v", same.Ranges)
+	}
+
+	removed := diffRanges("old", oldSet, "empty", rangeSet{}, false)
+	if removed.Summary.Removed.Int64() != 768+256 {
+		t.Errorf("removed=%s, want %d", removed.Summary.Removed, 768+256)
+	}
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// enrichBatchSize is the number of records handed to a worker at a time
+const enrichBatchSize = 256
+
+// defaultEnrichFields are the fields appended by enrich unless -fields is given
+const defaultEnrichFields = "country_code,city,isp,netspeed,ufi,geohash"
+
+// enrichRecord is a record of input: a line of a log or of JSON, or the
+// fields of a CSV row
+type enrichRecord struct {
+	line   string
+	fields []string
+}
+
+// enricher appends lookup results to the records of an input format:
+//
+//	combined  Apache/nginx combined logs, with name="value" pairs appended
+//	csv       CSV rows, with a column appended for each field
+//	json      JSON objects, one per line, with a key added for each field
+type enricher struct {
+	gen    *generation
+	format string
+	column int      // index of the address in combined and csv records
+	key    []string // path to the address in json records
+	cols   []ipinfoField
+	prefix string
+}
+
+// logField returns the nth field of a combined log line, counting from 0.
+// Fields are separated by spaces; a field in quotes or brackets may contain
+// spaces.
+func logField(line string, n int) string {
+	for i := 0; i < len(line); {
+		if line[i] == ' ' {
+			i++
+			continue
+		}
+
+		var field string
+		switch line[i] {
+		case '"':
+			j := i + 1
+			for j < len(line) && line[j] != '"' {
+				if line[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j > len(line) {
+				j = len(line)
+			}
+			field = line[i+1 : j]
+			i = j + 1
+		case '[':
+			j := strings.IndexByte(line[i:], ']')
+			if j < 0 {
+				j = len(line) - i
+			}
+			field = line[i+1 : i+j]
+			i += j + 1
+		default:
+			j := strings.IndexByte(line[i:], ' ')
+			if j < 0 {
+				j = len(line) - i
+			}
+			field = line[i : i+j]
+			i += j
+		}
+
+		if n == 0 {
+			return field
+		}
+		n--
+	}
+	return ""
+}
+
+// firstAddr returns the first of a comma-separated list of addresses, as
+// found in X-Forwarded-For
+func firstAddr(s string) string {
+	if i := strings.IndexByte(s, ','); i >= 0 {
+		s = s[:i]
+	}
+	return strings.TrimSpace(s)
+}
+
+// jsonAddr returns the string at path in a JSON object
+func jsonAddr(obj map[string]interface{}, path []string) string {
+	var v interface{} = obj
+	for _, k := range path {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		v = m[k]
+	}
+	s, _ := v.(string)
+	return s
+}
+
+// lookup returns the values of the selected fields for ip, and whether it
+// was found
+func (e *enricher) lookup(ip string) ([]string, bool) {
+	values := make([]string, len(e.cols))
+	ipinfo, err := e.gen.lookupIPInfoFields(firstAddr(ip), fieldsOf(e.cols))
+	if err != nil {
+		return values, false
+	}
+	ipinfo.IPStatus = "OK"
+	for i, c := range e.cols {
+		values[i] = c.text(&ipinfo)
+	}
+	return values, true
+}
+
+// names returns the names of the appended fields
+func (e *enricher) names() []string {
+	names := make([]string, len(e.cols))
+	for i, c := range e.cols {
+		names[i] = e.prefix + c.name
+	}
+	return names
+}
+
+// enrich writes records to w with the selected fields appended, returning
+// the number without a valid address
+func (e *enricher) enrich(w *bytes.Buffer, records []enrichRecord) int {
+	var missing int
+	names := e.names()
+
+	switch e.format {
+	case "csv":
+		cw := csv.NewWriter(w)
+		for _, rec := range records {
+			var ip string
+			if e.column < len(rec.fields) {
+				ip = rec.fields[e.column]
+			}
+			values, ok := e.lookup(ip)
+			if !ok {
+				missing++
+			}
+			cw.Write(append(rec.fields, values...))
+		}
+		cw.Flush()
+
+	case "combined":
+		for _, rec := range records {
+			if strings.TrimSpace(rec.line) == "" {
+				w.WriteString(rec.line + "\n")
+				continue
+			}
+			values, ok := e.lookup(logField(rec.line, e.column))
+			if !ok {
+				missing++
+			}
+			w.WriteString(rec.line)
+			for i, v := range values {
+				fmt.Fprintf(w, " %s=%s", names[i], strconv.Quote(v))
+			}
+			w.WriteByte('\n')
+		}
+
+	case "json":
+		for _, rec := range records {
+			line := strings.TrimRight(rec.line, " \t")
+			var obj map[string]interface{}
+			if err := json.Unmarshal([]byte(line), &obj); err != nil || obj == nil {
+				// not an object, so nothing can be added to it
+				if strings.TrimSpace(line) != "" {
+					missing++
+				}
+				w.WriteString(rec.line + "\n")
+				continue
+			}
+
+			values, ok := e.lookup(jsonAddr(obj, e.key))
+			if !ok {
+				missing++
+			}
+			w.WriteString(line[:strings.LastIndexByte(line, '}')])
+			for i, v := range values {
+				if i > 0 || len(obj) > 0 {
+					w.WriteByte(',')
+				}
+				k, _ := json.Marshal(names[i])
+				s, _ := json.Marshal(v)
+				w.Write(k)
+				w.WriteByte(':')
+				w.Write(s)
+			}
+			w.WriteString("}\n")
+		}
+	}
+
+	return missing
+}
+
+// recordReader returns a function reading the next record of r
+func (e *enricher) recordReader(r io.Reader) func() (enrichRecord, error) {
+	if e.format == "csv" {
+		cr := csv.NewReader(r)
+		cr.FieldsPerRecord = -1
+		return func() (enrichRecord, error) {
+			fields, err := cr.Read()
+			return enrichRecord{fields: fields}, err
+		}
+	}
+
+	br := bufio.NewReader(r)
+	return func() (enrichRecord, error) {
+		line, err := br.ReadString('\n')
+		if err == io.EOF && line != "" {
+			// the last line has no newline; EOF comes with the next read
+			err = nil
+		}
+		return enrichRecord{line: strings.TrimRight(line, "\r\n")}, err
+	}
+}
+
+// enrichBatch is a batch of records being enriched by a worker
+type enrichBatch struct {
+	records []enrichRecord
+	out     bytes.Buffer
+	missing int
+	done    chan struct{}
+}
+
+// run enriches each record returned by next, writing them to w in their
+// input order.  Batches of records are enriched in parallel by workers
+// goroutines.  It returns the number of records, and the number without a
+// valid address.
+func (e *enricher) run(next func() (enrichRecord, error), w io.Writer, workers int) (int, int, error) {
+	jobs := make(chan *enrichBatch)
+	// batches waiting to be written, in order; the buffer bounds how far
+	// reading can get ahead of writing
+	order := make(chan *enrichBatch, 2*workers)
+	stop := make(chan struct{})
+	var readErr error
+
+	go func() {
+		defer close(jobs)
+		defer close(order)
+		var err error
+		for err == nil {
+			b := &enrichBatch{done: make(chan struct{})}
+			for len(b.records) < enrichBatchSize {
+				var rec enrichRecord
+				if rec, err = next(); err != nil {
+					break
+				}
+				b.records = append(b.records, rec)
+			}
+			if len(b.records) == 0 {
+				continue
+			}
+			select {
+			case order <- b:
+			case <-stop:
+				return
+			}
+			jobs <- b
+		}
+		if err != io.EOF {
+			readErr = err
+		}
+	}()
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			for b := range jobs {
+				b.missing = e.enrich(&b.out, b.records)
+				close(b.done)
+			}
+		}()
+	}
+
+	var records, missing int
+	var err error
+	for b := range order {
+		<-b.done
+		if err != nil {
+			continue
+		}
+		if _, err = w.Write(b.out.Bytes()); err != nil {
+			close(stop)
+			continue
+		}
+		records += len(b.records)
+		missing += b.missing
+	}
+
+	if err == nil {
+		err = readErr
+	}
+	return records, missing, err
+}
+
+// enrichMain implements the enrich command
+func enrichMain(config dataConfig, args []string) int {
+	fs := flag.NewFlagSet("enrich", flag.ExitOnError)
+	format := fs.String("format", "combined", "input format: combined, csv or json")
+	field := fs.String("field", "", "field holding the address: a 1-based field number for combined logs, a column number or, with -header, name for csv, or a dotted key for json (default the first field, or ip for json)")
+	header := fs.Bool("header", false, "the first csv row is a header")
+	fields := fs.String("fields", defaultEnrichFields, "comma-separated fields to append")
+	prefix := fs.String("prefix", "rgip_", "prefix for the names of appended fields")
+	workers := fs.Int("workers", runtime.NumCPU(), "number of records enriched in parallel")
+	output := fs.String("o", "", "output file (default stdout)")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: rgip [data flags] enrich [flags] [input]")
+		fmt.Fprintln(os.Stderr, "input is read from stdin if not given")
+		fmt.Fprintln(os.Stderr, "fields:", strings.Join(fieldNames(), ","))
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() > 1 || *workers < 1 {
+		fs.Usage()
+		return 2
+	}
+
+	cols, err := selectIPInfoFields(*fields)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	e := &enricher{format: *format, cols: cols, prefix: *prefix}
+	switch *format {
+	case "combined", "csv":
+		if *field != "" {
+			n, err := strconv.Atoi(*field)
+			switch {
+			case err == nil && n > 0:
+				e.column = n - 1
+			case *format == "csv" && *header:
+				e.column = -1
+			default:
+				fmt.Fprintf(os.Stderr, "bad -field %q: must be a field number\n", *field)
+				return 2
+			}
+		}
+	case "json":
+		if *field == "" {
+			*field = "ip"
+		}
+		e.key = strings.Split(*field, ".")
+	default:
+		fmt.Fprintf(os.Stderr, "unknown input format %q\n", *format)
+		return 2
+	}
+
+	in := os.Stdin
+	if fs.NArg() == 1 && fs.Arg(0) != "-" {
+		in, err = os.Open(fs.Arg(0))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "can't open input file:", err)
+			return 1
+		}
+		defer in.Close()
+	}
+
+	results, err := loadDataFiles(config)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error loading data files:", err)
+		for _, r := range results {
+			if !r.OK {
+				fmt.Fprintf(os.Stderr, "unable to load %s: %s\n", r.Path, r.Error)
+			}
+		}
+		return 1
+	}
+
+	e.gen = acquireGeneration()
+	defer e.gen.release()
+
+	out := os.Stdout
+	if *output != "" {
+		out, err = os.Create(*output)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "can't create output file:", err)
+			return 1
+		}
+	}
+	w := bufio.NewWriter(out)
+
+	next := e.recordReader(in)
+	if *format == "csv" && *header {
+		rec, err := next()
+		if err != nil && err != io.EOF {
+			fmt.Fprintln(os.Stderr, "can't read header:", err)
+			return 1
+		}
+		if e.column < 0 {
+			for i, name := range rec.fields {
+				if name == *field {
+					e.column = i
+				}
+			}
+			if e.column < 0 {
+				fmt.Fprintf(os.Stderr, "no column %q in header\n", *field)
+				return 1
+			}
+		}
+		if err == nil {
+			cw := csv.NewWriter(w)
+			cw.Write(append(rec.fields, e.names()...))
+			cw.Flush()
+		}
+	}
+
+	records, missing, err := e.run(next, w, *workers)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = out.Close()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "enrich failed:", err)
+		return 1
+	}
+
+	if missing > 0 {
+		fmt.Fprintf(os.Stderr, "%d of %d records had no valid address\n", missing, records)
+	}
+	return 0
+}
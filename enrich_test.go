@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestLogField(t *testing.T) {
+	line := `1.2.3.4 - frank [10/Oct/2000:13:55:36 -0700] "GET /a \"b\" HTTP/1.0" 200 2326 "-" "Mozilla/4.08" "5.6.7.8, 9.9.9.9"`
+	for n, want := range []string{"1.2.3.4", "-", "frank", "10/Oct/2000:13:55:36 -0700", `GET /a \"b\" HTTP/1.0`, "200", "2326", "-", "Mozilla/4.08", "5.6.7.8, 9.9.9.9", ""} {
+		if got := logField(line, n); got != want {
+			t.Errorf("logField(%d)=%q, want %q", n, got, want)
+		}
+	}
+	if got := logField(`1.2.3.4 "unterminated`, 1); got != "unterminated" {
+		t.Errorf("logField(unterminated)=%q", got)
+	}
+}
+
+func testEnricher(format string) *enricher {
+	gen := testGeneration()
+	cols, _ := selectIPInfoFields("ufi,ip_status")
+	return &enricher{gen: gen, format: format, cols: cols, prefix: "rgip_"}
+}
+
+func TestEnrich(t *testing.T) {
+	for _, tt := range []struct {
+		format  string
+		column  int
+		key     []string
+		in      string
+		want    string
+		missing int
+	}{
+		{
+			format:  "combined",
+			in:      "1.2.3.4 - - [x] \"GET / HTTP/1.1\" 200 1\n\nbogus - -\n",
+			want:    "1.2.3.4 - - [x] \"GET / HTTP/1.1\" 200 1 rgip_ufi=\"7\" rgip_ip_status=\"OK\"\n\nbogus - - rgip_ufi=\"\" rgip_ip_status=\"\"\n",
+			missing: 1,
+		},
+		{
+			format: "combined",
+			column: 2,
+			in:     `9.9.9.9 - "1.2.3.4, 8.8.8.8"`,
+			want:   `9.9.9.9 - "1.2.3.4, 8.8.8.8" rgip_ufi="7" rgip_ip_status="OK"` + "\n",
+		},
+		{
+			format:  "csv",
+			column:  1,
+			in:      "a,1.2.3.4\r\n\"b,c\",bogus\nshort\n",
+			want:    "a,1.2.3.4,7,OK\n\"b,c\",bogus,,\nshort,,\n",
+			missing: 2,
+		},
+		{
+			format:  "json",
+			key:     []string{"client", "ip"},
+			in:      "{\"client\": {\"ip\": \"1.2.3.4\"}, \"n\": 1}\r\n{}\nnot json\n[1]\n",
+			want:    "{\"client\": {\"ip\": \"1.2.3.4\"}, \"n\": 1,\"rgip_ufi\":\"7\",\"rgip_ip_status\":\"OK\"}\n{\"rgip_ufi\":\"\",\"rgip_ip_status\":\"\"}\nnot json\n[1]\n",
+			missing: 3,
+		},
+	} {
+		e := testEnricher(tt.format)
+		e.column = tt.column
+		e.key = tt.key
+
+		var out bytes.Buffer
+		records, missing, err := e.run(e.recordReader(strings.NewReader(tt.in)), &out, 2)
+		if err != nil {
+			t.Errorf("%s: %s", tt.format, err)
+			continue
+		}
+		if out.String() != tt.want {
+			t.Errorf("%s output:\n%q\nwant:\n%q", tt.format, out.String(), tt.want)
+		}
+		if missing != tt.missing {
+			t.Errorf("%s: %d of %d records missing, want %d", tt.format, missing, records, tt.missing)
+		}
+	}
+}
+
+func TestEnrichOrder(t *testing.T) {
+	e := testEnricher("combined")
+
+	var in, want bytes.Buffer
+	for i := 0; i < 10*enrichBatchSize+3; i++ {
+		ip := fmt.Sprintf("1.2.3.%d", i%256)
+		if i%7 == 0 {
+			ip = fmt.Sprintf("bogus%d", i)
+			fmt.Fprintf(&want, "%s rgip_ufi=\"\" rgip_ip_status=\"\"\n", ip)
+		} else {
+			fmt.Fprintf(&want, "%s rgip_ufi=\"7\" rgip_ip_status=\"OK\"\n", ip)
+		}
+		fmt.Fprintln(&in, ip)
+	}
+
+	var out bytes.Buffer
+	records, _, err := e.run(e.recordReader(&in), &out, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records != 10*enrichBatchSize+3 {
+		t.Errorf("enriched %d records, want %d", records, 10*enrichBatchSize+3)
+	}
+	if out.String() != want.String() {
+		t.Errorf("output out of order")
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+)
+
+// exportCIDRs writes each range as the minimal set of CIDR prefixes covering
+// it, in one of the formats:
+//
+//	csv    cidr,ufi rows
+//	nginx  a geo block setting $variable
+//	json   an array of {"cidr": ..., "ufi": ...} objects
+func exportCIDRs(file io.Writer, ranges rangeSet, format, variable string) error {
+	w := bufio.NewWriter(file)
+
+	var write func(n *net.IPNet, ufi int32)
+	first := true
+
+	switch format {
+	case "csv":
+		write = func(n *net.IPNet, ufi int32) {
+			fmt.Fprintf(w, "%s,%d\n", n, ufi)
+		}
+	case "nginx":
+		fmt.Fprintf(w, "geo $%s {\n", variable)
+		fmt.Fprintf(w, "    default 0;\n")
+		write = func(n *net.IPNet, ufi int32) {
+			fmt.Fprintf(w, "    %s %d;\n", n, ufi)
+		}
+	case "json":
+		w.WriteString("[")
+		write = func(n *net.IPNet, ufi int32) {
+			if !first {
+				w.WriteString(",")
+			}
+			first = false
+			b, _ := json.Marshal(struct {
+				CIDR string `json:"cidr"`
+				UFI  int32  `json:"ufi"`
+			}{n.String(), ufi})
+			w.WriteString("\n")
+			w.Write(b)
+		}
+	default:
+		return fmt.Errorf("unknown export format %q", format)
+	}
+
+	ranges.walk(
+		func(r ipRange) {
+			for _, n := range r.cidrs() {
+				write(n, ranges.table.get(r.data).UFI)
+			}
+		},
+		func(r ipRange6) {
+			for _, n := range r.cidrs() {
+				write(n, ranges.table.get(r.data).UFI)
+			}
+		},
+	)
+
+	switch format {
+	case "nginx":
+		w.WriteString("}\n")
+	case "json":
+		w.WriteString("\n]\n")
+	}
+
+	return w.Flush()
+}
+
+// exportFormats are the formats exportCIDRs writes
+var exportFormats = map[string]bool{"csv": true, "nginx": true, "json": true}
+
+// exportMain implements the export command
+func exportMain(args []string) int {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	format := fs.String("format", "csv", "output format: csv, nginx or json")
+	output := fs.String("o", "", "output file (default stdout)")
+	variable := fs.String("var", "ufi", "variable set by the nginx geo block")
+	merge := fs.Bool("merge", false, "coalesce adjacent ranges with the same UFI before exporting")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: rgip export [flags] input")
+		fmt.Fprintln(os.Stderr, "input may be a CSV, rgipMap binary or mmdb file")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	// check everything before creating, and so truncating, the output file
+	if !exportFormats[*format] {
+		fmt.Fprintf(os.Stderr, "unknown export format %q\n", *format)
+		return 2
+	}
+
+	ranges, err := loadRangeFile(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to load %s: %s\n", fs.Arg(0), err)
+		return 1
+	}
+
+	if *merge {
+		ranges = ranges.compact()
+	}
+
+	out := os.Stdout
+	if *output != "" {
+		out, err = os.Create(*output)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "can't create output file:", err)
+			return 1
+		}
+	}
+
+	err = exportCIDRs(out, ranges, *format, *variable)
+	if err == nil {
+		err = out.Close()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "export failed:", err)
+		return 1
+	}
+
+	return 0
+}
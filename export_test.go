@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExportCIDRs(t *testing.T) {
+	set := rangeSet{
+		v4: ipRangeList{
+			{0x01000000, 0x010000ff, 100},
+			{0x01000101, 0x01000102, 101},
+		},
+		v6: ipRange6List{
+			{uint128{0x20010db8 << 32, 0}, uint128{0x20010db8 << 32, 0xff}, 200},
+		},
+	}
+
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{"csv", `1.0.0.0/24,100
+1.0.1.1/32,101
+1.0.1.2/32,101
+2001:db8::/120,200
+`},
+		{"nginx", `geo $ufi {
+    default 0;
+    1.0.0.0/24 100;
+    1.0.1.1/32 101;
+    1.0.1.2/32 101;
+    2001:db8::/120 200;
+}
+`},
+		{"json", `[
+{"cidr":"1.0.0.0/24","ufi":100},
+{"cidr":"1.0.1.1/32","ufi":101},
+{"cidr":"1.0.1.2/32","ufi":101},
+{"cidr":"2001:db8::/120","ufi":200}
+]
+`},
+	}
+
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		if err := exportCIDRs(&buf, set, tt.format, "ufi"); err != nil {
+			t.Errorf("%s: %s", tt.format, err)
+			continue
+		}
+		if buf.String() != tt.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", tt.format, buf.String(), tt.want)
+		}
+	}
+
+	if err := exportCIDRs(&bytes.Buffer{}, set, "xml", "ufi"); err == nil {
+		t.Errorf("expected error for unknown format")
+	}
+}
+
+func TestExportMainKeepsOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rgipExport")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	input := filepath.Join(dir, "ranges.csv")
+	output := filepath.Join(dir, "out.csv")
+	ioutil.WriteFile(input, []byte("1.0.0.0,1.0.0.255,100\n"), 0644)
+	ioutil.WriteFile(output, []byte("keep\n"), 0644)
+
+	// a bad format or input mustn't truncate the output file
+	for _, args := range [][]string{
+		{"-format", "xml", "-o", output, input},
+		{"-o", output, filepath.Join(dir, "missing.csv")},
+	} {
+		if code := exportMain(args); code == 0 {
+			t.Errorf("exportMain(%q) succeeded", args)
+		}
+		if b, _ := ioutil.ReadFile(output); string(b) != "keep\n" {
+			t.Errorf("exportMain(%q) overwrote the output with %q", args, b)
+		}
+	}
+
+	if code := exportMain([]string{"-o", output, input}); code != 0 {
+		t.Errorf("exportMain failed: %d", code)
+	}
+	if b, _ := ioutil.ReadFile(output); string(b) != "1.0.0.0/24,100\n" {
+		t.Errorf("exported %q", b)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// fieldSet selects the fields of IPInfo looked up and returned
+type fieldSet uint32
+
+const (
+	fieldCityName fieldSet = 1 << iota
+	fieldCountryCode
+	fieldLatitude
+	fieldLongitude
+	fieldRegion
+	fieldRegionName
+	fieldPostalCode
+	fieldAreaCode
+	fieldTimeZone
+	fieldISP
+	fieldNetSpeed
+	fieldUFI
+	fieldGeoHash
+	fieldOLC
+
+	// cityFields are the fields of the city object
+	cityFields = fieldCityName | fieldCountryCode | fieldLatitude | fieldLongitude | fieldRegion | fieldRegionName | fieldPostalCode | fieldAreaCode | fieldTimeZone
+
+	allFields = cityFields | fieldISP | fieldNetSpeed | fieldUFI | fieldGeoHash | fieldOLC
+)
+
+// ipinfoField is a field of IPInfo selectable by name, both with fields= and
+// in the text output of the lookup and enrich commands.  The names are the
+// JSON keys of IPInfo and its city and ufi objects.  "city" selects the
+// whole city object in JSON, and the city name in text; the fields of the
+// ufi object each select the whole object in JSON.
+type ipinfoField struct {
+	name   string
+	fields fieldSet // fields are the parts of IPInfo it needs looked up
+	text   func(*IPInfo) string
+}
+
+func formatFloat32(f float32) string {
+	return strconv.FormatFloat(float64(f), 'f', -1, 32)
+}
+
+// cityText returns a function formatting a field of the city object, which
+// is empty if there is no city
+func cityText(f func(*City) string) func(*IPInfo) string {
+	return func(i *IPInfo) string {
+		if i.City == nil {
+			return ""
+		}
+		return f(i.City)
+	}
+}
+
+// ipinfoFields are the selectable fields.  The ip and ip_status keys are
+// always returned in JSON.
+var ipinfoFields = []ipinfoField{
+	{"ip", 0, func(i *IPInfo) string { return i.IP }},
+	{"ip_status", 0, func(i *IPInfo) string { return i.IPStatus }},
+	{"city", cityFields, cityText(func(c *City) string { return c.City })},
+	{"country_code", fieldCountryCode, cityText(func(c *City) string { return c.CountryCode })},
+	{"latitude", fieldLatitude, cityText(func(c *City) string { return formatFloat32(c.Latitude) })},
+	{"longitude", fieldLongitude, cityText(func(c *City) string { return formatFloat32(c.Longitude) })},
+	{"region", fieldRegion, cityText(func(c *City) string { return c.Region })},
+	{"region_name", fieldRegionName, cityText(func(c *City) string { return c.RegionName })},
+	{"postal_code", fieldPostalCode, cityText(func(c *City) string { return c.PostalCode })},
+	{"area_code", fieldAreaCode, cityText(func(c *City) string { return strconv.Itoa(c.AreaCode) })},
+	{"time_zone", fieldTimeZone, cityText(func(c *City) string { return c.TimeZone })},
+	{"isp", fieldISP, func(i *IPInfo) string { return i.ISP }},
+	{"netspeed", fieldNetSpeed, func(i *IPInfo) string { return i.NetSpeed }},
+	{"ufi", fieldUFI, func(i *IPInfo) string { return strconv.Itoa(int(i.UFI.GuessedUFI)) }},
+	{"confidence", fieldUFI, func(i *IPInfo) string { return formatFloat32(i.UFI.Confidence) }},
+	{"source", fieldUFI, func(i *IPInfo) string { return i.UFI.Source }},
+	{"label", fieldUFI, func(i *IPInfo) string { return i.UFI.Label }},
+	{"geohash", fieldGeoHash, func(i *IPInfo) string { return i.GeoHash }},
+	{"olc", fieldOLC, func(i *IPInfo) string { return i.OLC }},
+}
+
+// fieldNames returns the names of the selectable fields
+func fieldNames() []string {
+	names := make([]string, len(ipinfoFields))
+	for i, f := range ipinfoFields {
+		names[i] = f.name
+	}
+	return names
+}
+
+// selectIPInfoFields returns the fields named in a comma-separated list
+func selectIPInfoFields(s string) ([]ipinfoField, error) {
+	var selected []ipinfoField
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		found := false
+		for _, f := range ipinfoFields {
+			if f.name == name {
+				selected = append(selected, f)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown field %q", name)
+		}
+	}
+	return selected, nil
+}
+
+func (f fieldSet) has(fields fieldSet) bool {
+	return f&fields != 0
+}
+
+// fieldsOf returns the parts of IPInfo needed by the selected fields
+func fieldsOf(selected []ipinfoField) fieldSet {
+	var f fieldSet
+	for _, field := range selected {
+		f |= field.fields
+	}
+	return f
+}
+
+// parseFields parses a comma-separated list of field names
+func parseFields(s string) (fieldSet, error) {
+	selected, err := selectIPInfoFields(s)
+	if err != nil {
+		return 0, err
+	}
+	return fieldsOf(selected), nil
+}
+
+// requestFields returns the fields selected by a request's fields=
+// parameter, or all of them if it has none
+func requestFields(r *http.Request) (fieldSet, error) {
+	q := r.URL.Query()
+	if _, ok := q["fields"]; !ok {
+		return allFields, nil
+	}
+	return parseFields(q.Get("fields"))
+}
+
+// selectFields returns the value to encode as the JSON response for ipinfo
+// with only the selected fields
+func (ipinfo IPInfo) selectFields(f fieldSet) interface{} {
+	if f == allFields {
+		return ipinfo
+	}
+
+	m := map[string]interface{}{"ip": ipinfo.IP}
+	if ipinfo.IPStatus != "" {
+		m["ip_status"] = ipinfo.IPStatus
+	}
+	if f.has(fieldISP) {
+		m["isp"] = ipinfo.ISP
+	}
+	if f.has(fieldNetSpeed) {
+		m["netspeed"] = ipinfo.NetSpeed
+	}
+	if f.has(fieldUFI) {
+		m["ufi"] = ipinfo.UFI
+	}
+	if f.has(fieldGeoHash) && ipinfo.GeoHash != "" {
+		m["geohash"] = ipinfo.GeoHash
+	}
+	if f.has(fieldOLC) && ipinfo.OLC != "" {
+		m["olc"] = ipinfo.OLC
+	}
+
+	if c := ipinfo.City; c != nil && f.has(cityFields) {
+		city := make(map[string]interface{})
+		if f.has(fieldCityName) {
+			city["city"] = c.City
+		}
+		if f.has(fieldCountryCode) {
+			city["country_code"] = c.CountryCode
+		}
+		if f.has(fieldLatitude) {
+			city["latitude"] = c.Latitude
+		}
+		if f.has(fieldLongitude) {
+			city["longitude"] = c.Longitude
+		}
+		if f.has(fieldRegion) && c.Region != "" {
+			city["region"] = c.Region
+		}
+		if f.has(fieldRegionName) && c.RegionName != "" {
+			city["region_name"] = c.RegionName
+		}
+		if f.has(fieldPostalCode) && c.PostalCode != "" {
+			city["postal_code"] = c.PostalCode
+		}
+		if f.has(fieldAreaCode) {
+			city["area_code"] = c.AreaCode
+		}
+		if f.has(fieldTimeZone) && c.TimeZone != "" {
+			city["time_zone"] = c.TimeZone
+		}
+		m["city"] = city
+	}
+
+	return m
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseFields(t *testing.T) {
+	for _, tt := range []struct {
+		s    string
+		want fieldSet
+	}{
+		{"country_code,ufi", fieldCountryCode | fieldUFI},
+		{" isp , ip ,", fieldISP},
+		{"city,latitude", cityFields},
+		{"", 0},
+	} {
+		got, err := parseFields(tt.s)
+		if err != nil || got != tt.want {
+			t.Errorf("parseFields(%q)=%b, %v, want %b", tt.s, got, err, tt.want)
+		}
+	}
+
+	if _, err := parseFields("ufi,bogus"); err == nil {
+		t.Errorf("expected error for unknown field")
+	}
+}
+
+func TestSelectFields(t *testing.T) {
+	ipinfo := IPInfo{
+		IP:       "1.2.3.4",
+		City:     &City{City: "Amsterdam", CountryCode: "nl", Latitude: 52.37, TimeZone: "Europe/Amsterdam"},
+		ISP:      "Example",
+		NetSpeed: "Cable/DSL",
+		GeoHash:  "u173zq37x0",
+	}
+	ipinfo.UFI.GuessedUFI = 7
+
+	if got := ipinfo.selectFields(allFields); !reflect.DeepEqual(got, ipinfo) {
+		t.Errorf("selectFields(allFields)=%+v, want the IPInfo unchanged", got)
+	}
+
+	for _, tt := range []struct {
+		fields string
+		want   string
+	}{
+		{"country_code,ufi", `{"city":{"country_code":"nl"},"ip":"1.2.3.4","ufi":{"guessed_ufi":7}}`},
+		{"isp,region,olc", `{"city":{},"ip":"1.2.3.4","isp":"Example"}`},
+		{"", `{"ip":"1.2.3.4"}`},
+	} {
+		f, _ := parseFields(tt.fields)
+		b, _ := json.Marshal(ipinfo.selectFields(f))
+		if string(b) != tt.want {
+			t.Errorf("selectFields(%q)=%s, want %s", tt.fields, b, tt.want)
+		}
+	}
+}
+
+func TestLookupFields(t *testing.T) {
+	gen := testGeneration()
+	swapGeneration(gen)
+
+	// backends for unselected fields aren't looked up
+	if ipinfo, _ := gen.lookupIPInfoFields("1.2.3.4", fieldCountryCode); ipinfo.UFI.GuessedUFI != 0 {
+		t.Errorf("UFI looked up when not selected")
+	}
+
+	for _, tt := range []struct {
+		url  string
+		code int
+		want string
+	}{
+		{"/lookup/1.2.3.4?fields=ufi", 200, `{"ip":"1.2.3.4","ufi":{"guessed_ufi":7}}`},
+		{"/lookup/1.2.3.4?fields=isp", 200, `{"ip":"1.2.3.4","isp":""}`},
+		{"/lookup/1.2.3.4?fields=bogus", 400, ""},
+	} {
+		w := httptest.NewRecorder()
+		lookupHandler(w, httptest.NewRequest("GET", tt.url, nil))
+		if w.Code != tt.code {
+			t.Errorf("%s: status %d, want %d", tt.url, w.Code, tt.code)
+			continue
+		}
+		if tt.code == http.StatusOK && strings.TrimSpace(w.Body.String()) != tt.want {
+			t.Errorf("%s=%s, want %s", tt.url, w.Body.String(), tt.want)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	lookupsPostHandler(w, httptest.NewRequest("POST", "/lookups?fields=ufi", strings.NewReader("1.2.3.4\nbogus\n")))
+	want := `[{"ip":"1.2.3.4","ip_status":"OK","ufi":{"guessed_ufi":7}},{"ip":"bogus","ip_status":"ParseError","ufi":{"guessed_ufi":0}}]`
+	if got := strings.TrimSpace(w.Body.String()); got != want {
+		t.Errorf("POST /lookups?fields=ufi=%s, want %s", got, want)
+	}
+}
+
+func TestFieldNamesAreJSONKeys(t *testing.T) {
+	ipinfo := IPInfo{
+		IP:       "1.2.3.4",
+		City:     &City{City: "Amsterdam", CountryCode: "nl", Region: "07", RegionName: "Noord-Holland", PostalCode: "1012", TimeZone: "Europe/Amsterdam"},
+		IPStatus: "OK",
+		GeoHash:  "u173zq37x0",
+		OLC:      "9F469VXC+2X",
+	}
+	ipinfo.setUFI(rangeValue{UFI: 7, Confidence: 0.5, Source: "survey", Label: "office"})
+
+	// the names used by fields= and the text output of lookup and enrich
+	// are the keys of the JSON response
+	for _, f := range ipinfoFields {
+		sel, err := parseFields(f.name)
+		if err != nil {
+			t.Errorf("parseFields(%q): %s", f.name, err)
+			continue
+		}
+		b, _ := json.Marshal(ipinfo.selectFields(sel))
+		var m map[string]interface{}
+		json.Unmarshal(b, &m)
+		city, _ := m["city"].(map[string]interface{})
+		ufi, _ := m["ufi"].(map[string]interface{})
+		_, top := m[f.name]
+		_, inCity := city[f.name]
+		_, inUFI := ufi[f.name]
+		if !top && !inCity && !inUFI {
+			t.Errorf("field %q not a key of %s", f.name, b)
+		}
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgryski/rgip/mlog"
+	geoip2 "github.com/oschwald/geoip2-golang"
+	maxminddb "github.com/oschwald/maxminddb-golang"
+)
+
+// dataConfig names the data files that make up a generation
+type dataConfig struct {
+	Lite     bool   // Lite loads only GeoLiteCity.dat from DataDir
+	DataDir  string // DataDir is the directory containing the GeoIP data files
+	Data2Dir string // Data2Dir is the directory containing the GeoIP2 data files, if any
+	UFI      string // UFI is the iprange-to-UFI file, if any
+	UFI2     string // UFI2 is the iprange-to-UFI mmdb file, if any
+	IsBinary bool   // IsBinary loads UFI as a binary file
+	Mmap     bool   // Mmap memory-maps UFI
+	Shard    bool   // Shard indexes UFI by first octet
+}
+
+// geoIPFiles returns the names of the GeoIP data files to load from
+// DataDir: the city database, then the netspeed and ISP databases unless
+// Lite is set
+func (config dataConfig) geoIPFiles() []string {
+	if config.Lite {
+		return []string{"GeoLiteCity.dat"}
+	}
+	return []string{
+		"GeoIPCity.dat",     // This IP is in "Amsterdam"
+		"GeoIPNetSpeed.dat", // This IP belongs to Vodafone and it's a mobile thing, or it's Comcast / DSL..
+		"GeoIPISP.dat",      // This is "Time Warner" or "AOL"
+	}
+}
+
+// files returns the paths of every data file named by config
+func (config dataConfig) files() []string {
+	var files []string
+	for _, f := range config.geoIPFiles() {
+		files = append(files, path.Join(config.DataDir, f))
+	}
+	if config.Data2Dir != "" {
+		files = append(files, path.Join(config.Data2Dir, "GeoLite2-City.mmdb"))
+	}
+	for _, f := range []string{config.UFI, config.UFI2} {
+		if f != "" {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+// generation is a complete set of databases.  A generation is loaded and
+// checked as a whole before being swapped in, so lookups never see a mix of
+// old and new files.
+type generation struct {
+	id     uint64
+	loaded time.Time
+
+	city   *geodb
+	speed  *geodb
+	isp    *geodb
+	ufis   *ipRanges
+	g2city *geoip2.Reader
+	g2ufi  *maxminddb.Reader
+
+	files []dataFile // files describes the files the databases were loaded from
+
+	// refs counts the requests using the generation, so it's only closed
+	// once they're done
+	refs sync.WaitGroup
+}
+
+// current is the generation serving lookups.  Until the first load it's an
+// empty generation with id 0.
+var current = struct {
+	sync.RWMutex
+	gen    *generation
+	lastID uint64
+}{gen: new(generation)}
+
+// reloadMu serializes loads, so concurrent reload requests can't interleave
+var reloadMu sync.Mutex
+
+// reloading is non-zero while loadDataFiles is running
+var reloading int32
+
+// acquireGeneration returns the current generation, which must be released
+// once the caller is done with it
+func acquireGeneration() *generation {
+	current.RLock()
+	gen := current.gen
+	gen.refs.Add(1)
+	current.RUnlock()
+	return gen
+}
+
+func (gen *generation) release() {
+	gen.refs.Done()
+}
+
+// generationInfo is the expvar representation of a generation
+type generationInfo struct {
+	ID     uint64    `json:"id"`
+	Loaded time.Time `json:"loaded"`
+}
+
+func (gen *generation) info() generationInfo {
+	return generationInfo{ID: gen.id, Loaded: gen.loaded}
+}
+
+// setHeader tells the client which generation answered the request
+func (gen *generation) setHeader(w http.ResponseWriter) {
+	w.Header().Set("X-Rgip-Generation", strconv.FormatUint(gen.id, 10))
+}
+
+// dataFile describes a file loaded into a generation
+type dataFile struct {
+	Path         string     `json:"path"`
+	Size         int64      `json:"size"`
+	Modified     time.Time  `json:"modified"`
+	Records      int        `json:"records,omitempty"`       // Records is the number of ranges in a UFI file
+	Info         string     `json:"info,omitempty"`          // Info is the libGeoIP description of a .dat file
+	DatabaseType string     `json:"database_type,omitempty"` // DatabaseType is from the metadata of an mmdb file
+	BuildEpoch   *time.Time `json:"build_epoch,omitempty"`   // BuildEpoch is from the metadata of an mmdb file
+	Nodes        uint       `json:"nodes,omitempty"`         // Nodes is the search tree size of an mmdb file
+}
+
+func (f *dataFile) setMetadata(m maxminddb.Metadata) {
+	built := time.Unix(int64(m.BuildEpoch), 0).UTC()
+	f.DatabaseType, f.BuildEpoch, f.Nodes = m.DatabaseType, &built, m.NodeCount
+}
+
+// fileResult is the outcome of loading one data file
+type fileResult struct {
+	Path  string `json:"path"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// buildGeneration loads every database named by config, returning the
+// outcome for each file.  If any of them fails to load, the rest are closed
+// and the first error returned.
+func buildGeneration(config dataConfig) (*generation, []fileResult, error) {
+	gen := new(generation)
+
+	var results []fileResult
+	var firstErr error
+
+	// load calls open to load fname, recording the outcome
+	load := func(fname string, open func(f *dataFile) error) {
+		f := dataFile{Path: fname}
+		if fi, err := os.Stat(fname); err == nil {
+			f.Size, f.Modified = fi.Size(), fi.ModTime()
+		}
+
+		result := fileResult{Path: fname, OK: true}
+		if err := open(&f); err != nil {
+			result.OK, result.Error = false, err.Error()
+			if firstErr == nil {
+				firstErr = err
+			}
+		} else {
+			gen.files = append(gen.files, f)
+		}
+		results = append(results, result)
+	}
+
+	dbs := []**geodb{&gen.city, &gen.speed, &gen.isp}
+	for i, file := range config.geoIPFiles() {
+		db := dbs[i]
+		load(path.Join(config.DataDir, file), func(f *dataFile) (err error) {
+			*db, err = openGeoDB(config.DataDir, file)
+			if err == nil {
+				f.Info = (*db).db.Info()
+			}
+			return err
+		})
+	}
+
+	if config.Data2Dir != "" {
+		load(path.Join(config.Data2Dir, "GeoLite2-City.mmdb"), func(f *dataFile) (err error) {
+			gen.g2city, err = geoip2.Open(f.Path)
+			if err != nil {
+				mlog.Println("error loading geoip2:", err)
+				return err
+			}
+			f.setMetadata(gen.g2city.Metadata())
+			return nil
+		})
+	}
+
+	if config.UFI2 != "" {
+		load(config.UFI2, func(f *dataFile) (err error) {
+			gen.g2ufi, err = maxminddb.Open(f.Path)
+			if err != nil {
+				mlog.Println("error loading ip2ufi:", err)
+				return err
+			}
+			f.setMetadata(gen.g2ufi.Metadata)
+			return nil
+		})
+	}
+
+	if config.UFI != "" {
+		// ip -> ufi mapping
+		load(config.UFI, func(f *dataFile) (err error) {
+			var ranges rangeLookuper
+			switch {
+			case config.Mmap:
+				ranges, err = openMmapRanges(config.UFI)
+			case config.Shard:
+				var set rangeSet
+				set, err = loadIPRanges(config.UFI, config.IsBinary)
+				if err == nil {
+					ranges, err = set.shard()
+				}
+			default:
+				ranges, err = loadIPRanges(config.UFI, config.IsBinary)
+			}
+			if err != nil {
+				mlog.Printf("unable to load %s: %s", config.UFI, err)
+				return err
+			}
+			gen.ufis = new(ipRanges)
+			gen.ufis.swap(ranges)
+			gen.ufis.setIndex(buildUFIIndex(ranges))
+			ranges.walk(func(ipRange) { f.Records++ }, func(ipRange6) { f.Records++ })
+			return nil
+		})
+	}
+
+	if firstErr != nil {
+		gen.close()
+		return nil, results, firstErr
+	}
+
+	return gen, results, nil
+}
+
+// check sanity checks a newly loaded generation before it's swapped in.
+// The UFI ranges must pass the checks of the validate command, however they
+// were loaded.
+func (gen *generation) check(config dataConfig) error {
+	if gen.ufis == nil {
+		return nil
+	}
+	if gen.ufis.empty() {
+		return fmt.Errorf("%s: no ranges loaded", config.UFI)
+	}
+	report := gen.ufis.validate()
+	if p, ok := report.firstError(); ok {
+		return fmt.Errorf("%s: %d errors, first: %s", config.UFI, report.errors(), p)
+	}
+	return nil
+}
+
+// close releases the generation's databases.  The mmdb readers unmap their
+// files, so this must wait until no lookups are using the generation.
+func (gen *generation) close() {
+	for _, db := range []*geodb{gen.city, gen.speed, gen.isp} {
+		if db != nil {
+			db.Close()
+		}
+	}
+	if gen.g2city != nil {
+		gen.g2city.Close()
+	}
+	if gen.g2ufi != nil {
+		gen.g2ufi.Close()
+	}
+	if gen.ufis != nil {
+		if err := gen.ufis.Close(); err != nil {
+			mlog.Println("error releasing old ranges:", err)
+		}
+	}
+}
+
+// swapGeneration makes gen current, closing the previous generation once
+// the requests using it have finished
+func swapGeneration(gen *generation) {
+	current.Lock()
+	current.lastID++
+	gen.id = current.lastID
+	gen.loaded = time.Now()
+	old := current.gen
+	current.gen = gen
+	current.Unlock()
+
+	go func() {
+		old.refs.Wait()
+		old.close()
+	}()
+}
+
+// loadDataFiles loads a new generation of the databases named by config and
+// swaps it in, returning the outcome for each file.  If anything fails to
+// load the current generation is kept.
+func loadDataFiles(config dataConfig) ([]fileResult, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	atomic.StoreInt32(&reloading, 1)
+	defer atomic.StoreInt32(&reloading, 0)
+
+	Metrics.Reloads.Add(1)
+
+	gen, results, err := buildGeneration(config)
+	if err == nil {
+		err = installGeneration(gen, config)
+	}
+	if err != nil {
+		Metrics.ReloadErrors.Add(1)
+		return results, err
+	}
+
+	mlog.Printf("generation %d loaded", gen.id)
+
+	return results, nil
+}
+
+// installGeneration checks a newly built generation and swaps it in, or
+// closes it if the check fails
+func installGeneration(gen *generation, config dataConfig) error {
+	if err := gen.check(config); err != nil {
+		mlog.Println("rejecting new data files:", err)
+		gen.close()
+		return err
+	}
+	swapGeneration(gen)
+	return nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	maxminddb "github.com/oschwald/maxminddb-golang"
+)
+
+// closeRecorder is a range list that records being closed
+type closeRecorder struct {
+	rangeSet
+	closed chan struct{}
+}
+
+func (c *closeRecorder) Close() error {
+	close(c.closed)
+	return nil
+}
+
+func TestSwapGeneration(t *testing.T) {
+	oldRanges := &closeRecorder{rangeSet: rangeSet{v4: ipRangeList{{0, 0xff, 1}}}, closed: make(chan struct{})}
+	old := &generation{ufis: new(ipRanges)}
+	old.ufis.swap(oldRanges)
+	swapGeneration(old)
+
+	gen := acquireGeneration()
+	if gen != old {
+		t.Fatalf("acquired generation %d, want %d", gen.id, old.id)
+	}
+
+	next := &generation{ufis: new(ipRanges)}
+	next.ufis.swap(rangeSet{v4: ipRangeList{{0, 0xff, 2}}})
+	swapGeneration(next)
+
+	if next.id != old.id+1 {
+		t.Errorf("new generation id %d, want %d", next.id, old.id+1)
+	}
+
+	// the old generation is still in use
+	if v, ok := gen.ufis.lookup(1); !ok || v.UFI != 1 {
+		t.Errorf("old generation lookup=(%v, %v), want UFI 1", v, ok)
+	}
+	select {
+	case <-oldRanges.closed:
+		t.Fatalf("old generation closed while in use")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	gen.release()
+	select {
+	case <-oldRanges.closed:
+	case <-time.After(time.Second):
+		t.Fatalf("old generation not closed after release")
+	}
+
+	gen = acquireGeneration()
+	defer gen.release()
+	if v, ok := gen.ufis.lookup(1); gen != next || !ok || v.UFI != 2 {
+		t.Errorf("new generation lookup=(%v, %v), want UFI 2", v, ok)
+	}
+}
+
+func TestLoadDataFilesKeepsGeneration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rgipData")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	before := acquireGeneration()
+	before.release()
+
+	results, err := loadDataFiles(dataConfig{Lite: true, DataDir: dir})
+	if err == nil {
+		t.Fatalf("expected error loading from an empty directory")
+	}
+	if len(results) != 1 || results[0].OK || results[0].Error == "" {
+		t.Errorf("results=%+v, want one failed file", results)
+	}
+
+	after := acquireGeneration()
+	after.release()
+	if after != before {
+		t.Errorf("failed load replaced generation %d with %d", before.id, after.id)
+	}
+}
+
+func TestInstallGenerationRejectsBadRanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rgipData")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the second range overlaps the first
+	csvName := path.Join(dir, "ufi.csv")
+	if err := ioutil.WriteFile(csvName, []byte("1.0.0.0,1.0.0.255,100\n1.0.0.128,1.0.1.255,101\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	set, err := loadIPRanges(csvName, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	binName := path.Join(dir, "ufi.bin")
+	f, err := os.Create(binName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writeBinary(f, set, binaryInfo{Created: time.Now(), Source: "test"})
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sharded, err := set.shard()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mapped, err := openMmapRanges(binName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := acquireGeneration()
+	before.release()
+
+	for _, ranges := range []rangeLookuper{set, sharded, mapped} {
+		gen := &generation{ufis: new(ipRanges)}
+		gen.ufis.swap(ranges)
+		if err := installGeneration(gen, dataConfig{UFI: csvName}); err == nil || !strings.Contains(err.Error(), "overlaps") {
+			t.Errorf("%T: installGeneration=%v, want overlap error", ranges, err)
+		}
+	}
+
+	after := acquireGeneration()
+	after.release()
+	if after != before {
+		t.Errorf("bad ranges replaced generation %d with %d", before.id, after.id)
+	}
+}
+
+func TestGenerationMMDB(t *testing.T) {
+	tempFile, err := ioutil.TempFile("", "rgipMMDB")
+	if err != nil {
+		t.Fatalf("couldn't create temp file")
+	}
+	defer os.Remove(tempFile.Name())
+
+	set := rangeSet{v4: ipRangeList{{0x01000000, 0x010000ff, 100}}}
+	err = writeMMDB(tempFile, set, mmdbOptions{RecordSize: 24, DatabaseType: "IP2UFI", BuildEpoch: time.Now()})
+	tempFile.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	old := &generation{}
+	if old.g2ufi, err = maxminddb.Open(tempFile.Name()); err != nil {
+		t.Fatal(err)
+	}
+	swapGeneration(old)
+
+	gen := acquireGeneration()
+	swapGeneration(&generation{})
+
+	// the reader stays mapped until the lookup is done
+	if v, ok, err := gen.mmdbIP2UFI(net.ParseIP("1.0.0.1")); err != nil || !ok || v.UFI != 100 {
+		t.Errorf("mmdbIP2UFI=(%v, %v, %v), want UFI 100", v, ok, err)
+	}
+	gen.release()
+}
@@ -152,6 +152,17 @@ func (db *Database) GetNameV6(ip string) (name string, netmask int) {
 	return name, netmask
 }
 
+// Info returns the description of the database reported by libGeoIP, which
+// includes its edition and build date.
+func (db *Database) Info() string {
+	cinfo := C.GeoIP_database_info(db.g)
+	if cinfo == nil {
+		return ""
+	}
+	defer C.free(unsafe.Pointer(cinfo))
+	return C.GoString(cinfo)
+}
+
 // Close releases the resources allocated by the database.
 func (db *Database) Close() error {
 	if db.g != nil {
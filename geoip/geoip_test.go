@@ -28,6 +28,18 @@ func TestOpen(t *testing.T) {
 	defer g.Close()
 }
 
+func TestInfo(t *testing.T) {
+	g, err := Open(*dbFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	if info := g.Info(); info == "" {
+		t.Errorf("Was empty, but expected a description")
+	}
+}
+
 func TestOpenBadFile(t *testing.T) {
 	g, err := Open("/example/usr/GeoIPCity.dat", nil)
 	if g != nil {
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// canary is an address with a known country, checked by the readiness probe
+type canary struct {
+	IP      string
+	Country string
+}
+
+// parseCanaries parses a comma-separated list of ip=country pairs
+func parseCanaries(s string) ([]canary, error) {
+	var canaries []canary
+	for _, c := range strings.Split(s, ",") {
+		kv := strings.SplitN(c, "=", 2)
+		if len(kv) != 2 || net.ParseIP(kv[0]) == nil || kv[1] == "" {
+			return nil, fmt.Errorf("bad canary %q, expected ip=country", c)
+		}
+		canaries = append(canaries, canary{IP: kv[0], Country: strings.ToLower(kv[1])})
+	}
+	return canaries, nil
+}
+
+// healthzHandler reports that the server is alive
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "ok")
+}
+
+// readyzHandler returns a handler reporting whether the server should be
+// sent traffic: the data files have loaded, no reload is in progress, and
+// each canary is found in its expected country
+func readyzHandler(canaries []canary) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		gen := acquireGeneration()
+		defer gen.release()
+
+		var problems []string
+		if gen.id == 0 {
+			problems = append(problems, "data files not loaded")
+		}
+		if atomic.LoadInt32(&reloading) != 0 {
+			problems = append(problems, "reload in progress")
+		}
+
+		for _, c := range canaries {
+			ipinfo, err := gen.lookupIPInfoFields(c.IP, fieldCountryCode)
+			var country string
+			if err == nil && ipinfo.City != nil {
+				country = ipinfo.CountryCode
+			}
+			if country != c.Country {
+				problems = append(problems, fmt.Sprintf("canary %s: country %q, want %q", c.IP, country, c.Country))
+			}
+		}
+
+		gen.setHeader(w)
+		if len(problems) > 0 {
+			http.Error(w, strings.Join(problems, "\n"), http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, "ok")
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestParseCanaries(t *testing.T) {
+	canaries, err := parseCanaries("8.8.8.8=US,2001:4860:4860::8888=us")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(canaries) != 2 || canaries[0] != (canary{"8.8.8.8", "us"}) {
+		t.Errorf("parseCanaries=%v", canaries)
+	}
+
+	for _, bad := range []string{"8.8.8.8", "8.8.8=us", "8.8.8.8=", "8.8.8.8=us,"} {
+		if _, err := parseCanaries(bad); err == nil {
+			t.Errorf("expected error parsing %q", bad)
+		}
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	swapGeneration(&generation{})
+
+	ready := func(canaries []canary) int {
+		w := httptest.NewRecorder()
+		readyzHandler(canaries)(w, httptest.NewRequest("GET", "/readyz", nil))
+		return w.Code
+	}
+
+	if code := ready(nil); code != http.StatusOK {
+		t.Errorf("status %d, want %d", code, http.StatusOK)
+	}
+
+	atomic.StoreInt32(&reloading, 1)
+	if code := ready(nil); code != http.StatusServiceUnavailable {
+		t.Errorf("status during reload %d, want %d", code, http.StatusServiceUnavailable)
+	}
+	atomic.StoreInt32(&reloading, 0)
+
+	// there's no city database to find the canary in
+	if code := ready([]canary{{"8.8.8.8", "us"}}); code != http.StatusServiceUnavailable {
+		t.Errorf("status with failing canary %d, want %d", code, http.StatusServiceUnavailable)
+	}
+}
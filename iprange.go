@@ -6,17 +6,34 @@ import (
 	"encoding/binary"
 	"encoding/csv"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"net"
 	"os"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/dgryski/rgip/mlog"
 )
 
 var magicBytes = []byte{'r', 'g', 'i', 'p', 'M', 'a', 'p', 0}
 
+// magicBytesV2 marks a binary file with a versioned, checksummed header
+var magicBytesV2 = []byte{'r', 'g', 'i', 'p', 'M', 'a', 'p', '2'}
+
+// binaryVersion is the format version written by writeBinary.  Version 3
+// added a section of IPv6 ranges following the IPv4 ones, and version 4 a
+// table of the values the ranges' data refer to.
+const binaryVersion = 4
+
+// maxSourceLen bounds the source description so a corrupt header can't trigger a huge allocation
+const maxSourceLen = 64 << 10
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
 const ipRangeSize = 12
 
 type ipRange struct {
@@ -26,8 +43,24 @@ type ipRange struct {
 
 type ipRangeList []ipRange
 
+// rangeLookuper is implemented by the different representations of a range list
+type rangeLookuper interface {
+	lookup(ip32 uint32) (int32, bool)
+	lookup6(ip uint128) (int32, bool)
+
+	// walk calls fn4 and fn6 with each IPv4 and IPv6 range in order
+	walk(fn4 func(ipRange), fn6 func(ipRange6))
+
+	// values returns the table the ranges' data index, or nil if the data are UFIs
+	values() valueTable
+
+	// count returns the number of IPv4 and IPv6 ranges
+	count() int
+}
+
 type ipRanges struct {
-	ranges ipRangeList
+	ranges rangeLookuper
+	index  ufiIndex
 	sync.RWMutex
 }
 
@@ -46,6 +79,25 @@ func (r ipRangeList) lookup(ip32 uint32) (int32, bool) {
 	return 0, false
 }
 
+// compact returns the list with adjacent ranges having the same value coalesced
+func (r ipRangeList) compact() ipRangeList {
+	if len(r) == 0 {
+		return r
+	}
+
+	out := ipRangeList{r[0]}
+	for _, v := range r[1:] {
+		last := &out[len(out)-1]
+		if last.data == v.data && last.rangeTo != ^uint32(0) && last.rangeTo+1 == v.rangeFrom {
+			last.rangeTo = v.rangeTo
+			continue
+		}
+		out = append(out, v)
+	}
+
+	return out
+}
+
 type shardedRangeList []ipRangeList
 
 func (r ipRangeList) shard() (shardedRangeList, error) {
@@ -70,7 +122,7 @@ func (r ipRangeList) shard() (shardedRangeList, error) {
 
 	for i := range shards {
 		if !sort.IsSorted(shards[i]) {
-			fmt.Println("sorting", i, "(items: ", len(shards[i]), ")")
+			mlog.Printf("sorting shard %d (items: %d)", i, len(shards[i]))
 			sort.Sort(shards[i])
 		}
 	}
@@ -82,87 +134,431 @@ func (s shardedRangeList) lookup(ip32 uint32) (int32, bool) {
 	return s[ip32>>24].lookup(ip32)
 }
 
-// lookup returns the found value, if any, followed by a bool indicating whether the value was found
-func (ipr *ipRanges) lookup(ip32 uint32) (int32, bool) {
+// shardStats summarizes how ranges are distributed across shards
+type shardStats struct {
+	Shards  int `json:"shards"`  // Shards is the number of non-empty shards
+	Ranges  int `json:"ranges"`  // Ranges is the total number of ranges, after splitting
+	Largest int `json:"largest"` // Largest is the number of ranges in the largest shard
+	Octet   int `json:"octet"`   // Octet is the first octet of the largest shard
+}
+
+func (s shardedRangeList) stats() shardStats {
+	var st shardStats
+	for i, r := range s {
+		if len(r) == 0 {
+			continue
+		}
+		st.Shards++
+		st.Ranges += len(r)
+		if len(r) > st.Largest {
+			st.Largest, st.Octet = len(r), i
+		}
+	}
+	return st
+}
+
+// shardedRangeSet is a rangeSet with the IPv4 ranges sharded by first octet
+type shardedRangeSet struct {
+	v4    shardedRangeList
+	v6    ipRange6List
+	table valueTable
+}
+
+func (s shardedRangeSet) lookup(ip32 uint32) (int32, bool) { return s.v4.lookup(ip32) }
+func (s shardedRangeSet) lookup6(ip uint128) (int32, bool) { return s.v6.lookup(ip) }
+func (s shardedRangeSet) values() valueTable               { return s.table }
+
+func (s shardedRangeSet) count() int {
+	n := len(s.v6)
+	for _, shard := range s.v4 {
+		n += len(shard)
+	}
+	return n
+}
+
+func (s shardedRangeSet) walk(fn4 func(ipRange), fn6 func(ipRange6)) {
+	for _, shard := range s.v4 {
+		for _, r := range shard {
+			fn4(r)
+		}
+	}
+	for _, r := range s.v6 {
+		fn6(r)
+	}
+}
+
+func (s rangeSet) shard() (shardedRangeSet, error) {
+	v4, err := s.v4.shard()
+	if err != nil {
+		return shardedRangeSet{}, err
+	}
+	return shardedRangeSet{v4: v4, v6: s.v6, table: s.table}, nil
+}
+
+// lookup returns the found record, if any, followed by a bool indicating whether the record was found
+func (ipr *ipRanges) lookup(ip32 uint32) (rangeValue, bool) {
+	ipr.RLock()
+	defer ipr.RUnlock()
+	data, ok := ipr.ranges.lookup(ip32)
+	if !ok {
+		return rangeValue{}, false
+	}
+	return ipr.ranges.values().get(data), true
+}
+
+// lookup6 is lookup for IPv6 addresses
+func (ipr *ipRanges) lookup6(ip uint128) (rangeValue, bool) {
+	ipr.RLock()
+	defer ipr.RUnlock()
+	data, ok := ipr.ranges.lookup6(ip)
+	if !ok {
+		return rangeValue{}, false
+	}
+	return ipr.ranges.values().get(data), true
+}
+
+// shardStats returns the shard statistics of the current ranges, or nil if they aren't sharded
+func (ipr *ipRanges) shardStats() *shardStats {
+	ipr.RLock()
+	defer ipr.RUnlock()
+	if s, ok := ipr.ranges.(shardedRangeSet); ok {
+		st := s.v4.stats()
+		return &st
+	}
+	return nil
+}
+
+// reverse returns the ranges assigned to ufi, or nil if there are none
+func (ipr *ipRanges) reverse(ufi int32) *rangeSet {
+	ipr.RLock()
+	defer ipr.RUnlock()
+	return ipr.index[ufi]
+}
+
+// setIndex sets the reverse index of the current range list
+func (ipr *ipRanges) setIndex(index ufiIndex) {
+	ipr.Lock()
+	ipr.index = index
+	ipr.Unlock()
+}
+
+// swap replaces the current range list, releasing the old one once no
+// lookups are using it.  The old index is dropped; see setIndex.
+func (ipr *ipRanges) swap(ranges rangeLookuper) {
+	ipr.Lock()
+	old := ipr.ranges
+	ipr.ranges = ranges
+	ipr.index = nil
+	ipr.Unlock()
+
+	if c, ok := old.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			mlog.Println("error releasing old ranges:", err)
+		}
+	}
+}
+
+// empty reports whether there are no ranges
+func (ipr *ipRanges) empty() bool {
 	ipr.RLock()
 	defer ipr.RUnlock()
-	return ipr.ranges.lookup(ip32)
+	return ipr.ranges == nil || ipr.ranges.count() == 0
+}
+
+// validate checks the current range list with validateRanges
+func (ipr *ipRanges) validate() *rangeReport {
+	ipr.RLock()
+	defer ipr.RUnlock()
+	return validateRanges(ipr.ranges)
+}
+
+// Close releases the current range list.  The ranges must not be used afterwards.
+func (ipr *ipRanges) Close() error {
+	ipr.Lock()
+	defer ipr.Unlock()
+	if c, ok := ipr.ranges.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// binaryInfo is the metadata stored in the header of a version 2 binary file
+type binaryInfo struct {
+	Version uint32    // Version is the format version of the file
+	Created time.Time // Created is when the file was generated
+	Source  string    // Source describes the input the file was generated from
+	Count   uint32    // Count is the number of IPv4 ranges in the file
+	Count6  uint32    // Count6 is the number of IPv6 ranges in the file
+	Values  uint32    // Values is the number of entries in the file's value table
 }
 
-func readMagicBytes(file io.Reader, name string) error {
-	b := make([]byte, len(magicBytes))
+func readMagicBytes(file io.Reader, name string, want []byte) error {
+	b := make([]byte, len(want))
 	_, err := io.ReadFull(file, b)
 	if err != nil {
 		return fmt.Errorf("error reading %s: %v", name, err)
 	}
 
-	if !bytes.Equal(b, magicBytes) {
-		return fmt.Errorf("file format is incorrect, expected %s '%s', actual '%s'", name, magicBytes, b)
+	if !bytes.Equal(b, want) {
+		return fmt.Errorf("file format is incorrect, expected %s '%s', actual '%s'", name, want, b)
 	}
 
 	return nil
 }
 
-func loadIPRangesFromBinary(file io.Reader) ([]ipRange, error) {
-	err := readMagicBytes(file, "header")
+// readBinary loads ranges from either a version 1 or version 2 binary file
+func readBinary(file io.Reader) (rangeSet, binaryInfo, error) {
+	magic := make([]byte, len(magicBytes))
+	_, err := io.ReadFull(file, magic)
 	if err != nil {
-		return nil, err
+		return rangeSet{}, binaryInfo{}, fmt.Errorf("error reading header: %v", err)
+	}
+
+	switch {
+	case bytes.Equal(magic, magicBytes):
+		ranges, err := readBinaryV1(file)
+		return rangeSet{v4: ranges}, binaryInfo{Version: 1, Count: uint32(len(ranges))}, err
+	case bytes.Equal(magic, magicBytesV2):
+		return readBinaryV2(file)
 	}
 
+	return rangeSet{}, binaryInfo{}, fmt.Errorf("file format is incorrect, expected header '%s' or '%s', actual '%s'", magicBytes, magicBytesV2, magic)
+}
+
+func readBinaryV1(file io.Reader) (ipRangeList, error) {
 	lenranges := make([]byte, 4)
-	_, err = io.ReadFull(file, lenranges)
+	_, err := io.ReadFull(file, lenranges)
 	if err != nil {
 		return nil, fmt.Errorf("can't read file size field %s", err)
 	}
 
-	ranges := make([]ipRange, binary.LittleEndian.Uint32(lenranges))
+	ranges, err := readRanges(file, binary.LittleEndian.Uint32(lenranges))
+	if err != nil {
+		return nil, err
+	}
+
+	err = readMagicBytes(file, "footer", magicBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return ranges, nil
+}
+
+func readBinaryV2(file io.Reader) (rangeSet, binaryInfo, error) {
+	var ranges rangeSet
+
+	// everything between the header and footer magic is covered by the checksum
+	crc := crc32.New(crcTable)
+	r := io.TeeReader(file, crc)
+
+	info, err := readHeaderV2(r)
+	if err != nil {
+		return ranges, info, err
+	}
+
+	ranges.v4, err = readRanges(r, info.Count)
+	if err != nil {
+		return ranges, info, err
+	}
+
+	var b [4]byte
+	if info.Version >= 3 {
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return ranges, info, fmt.Errorf("can't read IPv6 size field %s", err)
+		}
+		info.Count6 = binary.LittleEndian.Uint32(b[:])
+
+		ranges.v6, err = readRanges6(r, info.Count6)
+		if err != nil {
+			return ranges, info, err
+		}
+	}
+
+	if info.Version >= 4 {
+		ranges.table, err = readValueTable(r)
+		if err != nil {
+			return ranges, info, err
+		}
+		info.Values = uint32(len(ranges.table))
+	}
+
+	if _, err := io.ReadFull(file, b[:]); err != nil {
+		return ranges, info, fmt.Errorf("can't read checksum field: %s", err)
+	}
+	if err := checkChecksum(crc.Sum32(), b[:]); err != nil {
+		return ranges, info, err
+	}
+
+	err = readMagicBytes(file, "footer", magicBytesV2)
+	if err != nil {
+		return ranges, info, err
+	}
+
+	return ranges, info, nil
+}
+
+// readHeaderV2 reads the version 2 header fields following the magic bytes
+func readHeaderV2(r io.Reader) (binaryInfo, error) {
+	var info binaryInfo
+
+	var b [8]byte
+	if _, err := io.ReadFull(r, b[:4]); err != nil {
+		return info, fmt.Errorf("can't read version field: %s", err)
+	}
+	info.Version = binary.LittleEndian.Uint32(b[:])
+	if info.Version < 2 || info.Version > binaryVersion {
+		return info, fmt.Errorf("unsupported binary format version %d", info.Version)
+	}
+
+	if _, err := io.ReadFull(r, b[:8]); err != nil {
+		return info, fmt.Errorf("can't read timestamp field: %s", err)
+	}
+	info.Created = time.Unix(int64(binary.LittleEndian.Uint64(b[:])), 0).UTC()
+
+	if _, err := io.ReadFull(r, b[:4]); err != nil {
+		return info, fmt.Errorf("can't read source length field: %s", err)
+	}
+	srclen := binary.LittleEndian.Uint32(b[:])
+	if srclen > maxSourceLen {
+		return info, fmt.Errorf("source description too long: %d bytes", srclen)
+	}
+	src := make([]byte, srclen)
+	if _, err := io.ReadFull(r, src); err != nil {
+		return info, fmt.Errorf("can't read source field: %s", err)
+	}
+	info.Source = string(src)
+
+	if _, err := io.ReadFull(r, b[:4]); err != nil {
+		return info, fmt.Errorf("can't read file size field %s", err)
+	}
+	info.Count = binary.LittleEndian.Uint32(b[:])
+
+	return info, nil
+}
+
+func checkChecksum(sum uint32, b []byte) error {
+	if want := binary.LittleEndian.Uint32(b); sum != want {
+		return fmt.Errorf("checksum mismatch: expected %08x, actual %08x", want, sum)
+	}
+	return nil
+}
+
+// maxPrealloc bounds the entries allocated from a count read from a file.
+// Counts are read before the checksum can be verified, so a corrupt one must
+// fail when the input runs out rather than exhaust memory up front.
+const maxPrealloc = 1 << 16
+
+func preallocLen(n uint32) int {
+	if n > maxPrealloc {
+		return maxPrealloc
+	}
+	return int(n)
+}
+
+func readRanges(file io.Reader, n uint32) (ipRangeList, error) {
+	ranges := make(ipRangeList, 0, preallocLen(n))
 	b := make([]byte, ipRangeSize)
-	for i := range ranges {
-		_, err = io.ReadFull(file, b)
+	for i := uint32(0); i < n; i++ {
+		_, err := io.ReadFull(file, b)
 		if err != nil {
-			return nil, fmt.Errorf("expected %d items, got %d", len(ranges), i)
+			return nil, fmt.Errorf("expected %d items, got %d", n, i)
 		}
 
-		ranges[i] = ipRange{
+		ranges = append(ranges, ipRange{
 			binary.LittleEndian.Uint32(b[0:]),
 			binary.LittleEndian.Uint32(b[4:]),
 			int32(binary.LittleEndian.Uint32(b[8:])),
-		}
+		})
 	}
 
-	err = readMagicBytes(file, "footer")
-	if err != nil {
-		return nil, err
+	return ranges, nil
+}
+
+func readRanges6(file io.Reader, n uint32) (ipRange6List, error) {
+	ranges := make(ipRange6List, 0, preallocLen(n))
+	b := make([]byte, ipRange6Size)
+	for i := uint32(0); i < n; i++ {
+		_, err := io.ReadFull(file, b)
+		if err != nil {
+			return nil, fmt.Errorf("expected %d IPv6 items, got %d", n, i)
+		}
+
+		ranges = append(ranges, getRange6(b))
 	}
 
 	return ranges, nil
 }
 
-func writeBinary(file io.Writer, ranges []ipRange) error {
+// writeBinary writes ranges in the current binary format.  The Version and
+// Count fields of info are filled in from the data being written.
+func writeBinary(file io.Writer, ranges rangeSet, info binaryInfo) error {
+
+	if len(info.Source) > maxSourceLen {
+		return fmt.Errorf("source description too long: %d bytes", len(info.Source))
+	}
 
 	f := bufio.NewWriter(file)
 
-	if _, err := f.Write(magicBytes); err != nil {
+	if _, err := f.Write(magicBytesV2); err != nil {
 		return err
 	}
 
-	var b [ipRangeSize]byte
+	crc := crc32.New(crcTable)
+	w := io.MultiWriter(f, crc)
 
-	binary.LittleEndian.PutUint32(b[0:], uint32(len(ranges)))
-	if _, err := f.Write(b[:4]); err != nil {
+	var b [ipRange6Size]byte
+
+	binary.LittleEndian.PutUint32(b[0:], binaryVersion)
+	binary.LittleEndian.PutUint64(b[4:], uint64(info.Created.Unix()))
+	if _, err := w.Write(b[:12]); err != nil {
 		return err
 	}
 
-	for _, r := range ranges {
+	binary.LittleEndian.PutUint32(b[0:], uint32(len(info.Source)))
+	if _, err := w.Write(b[:4]); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, info.Source); err != nil {
+		return err
+	}
+
+	binary.LittleEndian.PutUint32(b[0:], uint32(len(ranges.v4)))
+	if _, err := w.Write(b[:4]); err != nil {
+		return err
+	}
+
+	for _, r := range ranges.v4 {
 		binary.LittleEndian.PutUint32(b[0:], r.rangeFrom)
 		binary.LittleEndian.PutUint32(b[4:], r.rangeTo)
 		binary.LittleEndian.PutUint32(b[8:], uint32(r.data))
-		if _, err := f.Write(b[:]); err != nil {
+		if _, err := w.Write(b[:ipRangeSize]); err != nil {
 			return err
 		}
 	}
 
-	if _, err := f.Write(magicBytes); err != nil {
+	binary.LittleEndian.PutUint32(b[0:], uint32(len(ranges.v6)))
+	if _, err := w.Write(b[:4]); err != nil {
+		return err
+	}
+
+	for _, r := range ranges.v6 {
+		putRange6(b[:], r)
+		if _, err := w.Write(b[:ipRange6Size]); err != nil {
+			return err
+		}
+	}
+
+	if err := writeValueTable(w, ranges.table); err != nil {
+		return err
+	}
+
+	binary.LittleEndian.PutUint32(b[0:], crc.Sum32())
+	if _, err := f.Write(b[:4]); err != nil {
+		return err
+	}
+
+	if _, err := f.Write(magicBytesV2); err != nil {
 		return err
 	}
 
@@ -172,12 +568,44 @@ func writeBinary(file io.Writer, ranges []ipRange) error {
 	return nil
 }
 
-func loadIPRangesFromCSV(file io.Reader) (ipRangeList, error) {
+// csvColumns names the columns of iprange-to-UFI CSV files, using the names
+// in csvFields.  If it's empty, the layout of each row is inferred from its
+// number of fields as described for loadIPRangesFromCSV.
+var csvColumns []string
+
+// loadIPRangesFromCSV parses rows in any of the following forms:
+//
+//	ipTo,data
+//	ipFrom,ipTo,data
+//	cidr,data
+//
+// An ipTo,data row starts one past the end of the previous range of the same
+// address family, so a file made only of those must be contiguous.  The
+// other forms give both ends of the range, and any address space between
+// ranges is left unmapped.  IPv4 addresses may be given as integers or in
+// dotted-quad form, IPv6 addresses in their textual form.
+func loadIPRangesFromCSV(file io.Reader) (rangeSet, error) {
+	return loadIPRangesFromCSVColumns(file, nil)
+}
+
+// loadIPRangesFromCSVColumns parses rows laid out as named by columns.  The
+// ranges' data index a value table built from the ufi, confidence, source
+// and label columns.  With no columns, it behaves as loadIPRangesFromCSV.
+func loadIPRangesFromCSVColumns(file io.Reader, columns []string) (rangeSet, error) {
+	if len(columns) > 0 {
+		if err := checkColumns(columns); err != nil {
+			return rangeSet{}, err
+		}
+	}
+
 	svr := csv.NewReader(file)
+	svr.FieldsPerRecord = -1
 
-	var ips ipRangeList
+	var ips rangeSet
+	var values valueTableBuilder
 
 	prevIP := -1
+	var nextIP6 uint128
 
 	for {
 		r, err := svr.Read()
@@ -187,25 +615,91 @@ func loadIPRangesFromCSV(file io.Reader) (ipRangeList, error) {
 
 		if err != nil {
 			mlog.Println("error reading CSV: ", err)
-			return nil, err
+			return rangeSet{}, err
 		}
 
-		var ipFrom, ipTo, data int
+		var ipFrom, ipTo net.IP
+		var data int
 
 		var convert converr
-		ipFrom = prevIP + 1
-		ipTo = convert.check(r[0])
-		data = convert.check(r[1])
-		prevIP = ipTo
+		switch {
+		case len(columns) > 0:
+			if len(r) != len(columns) {
+				convert.err = fmt.Errorf("expected %d fields, got %d", len(columns), len(r))
+				break
+			}
+			var v rangeValue
+			for i, c := range columns {
+				switch c {
+				case "from":
+					ipFrom = convert.addr(r[i])
+				case "to":
+					ipTo = convert.addr(r[i])
+				case "cidr":
+					ipFrom, ipTo = convert.cidr(r[i])
+				case "ufi":
+					v.UFI = int32(convert.check(r[i]))
+				case "confidence":
+					v.Confidence = convert.float(r[i])
+				case "source":
+					v.Source = r[i]
+				case "label":
+					v.Label = r[i]
+				}
+			}
+			data = int(values.add(v))
+		case len(r) == 3:
+			ipFrom = convert.addr(r[0])
+			ipTo = convert.addr(r[1])
+			data = convert.check(r[2])
+		case len(r) == 2 && strings.Contains(r[0], "/"):
+			ipFrom, ipTo = convert.cidr(r[0])
+			data = convert.check(r[1])
+		case len(r) == 2:
+			ipTo = convert.addr(r[0])
+			data = convert.check(r[1])
+		default:
+			convert.err = fmt.Errorf("expected 2 or 3 fields, got %d", len(r))
+		}
+
+		if convert.err == nil && ipFrom != nil && len(ipFrom) != len(ipTo) {
+			convert.err = fmt.Errorf("range mixes IPv4 and IPv6 addresses")
+		}
 
 		if convert.err != nil {
-			mlog.Printf("error parsing %v: %s", r, err)
-			return nil, convert.err
+			mlog.Printf("error parsing %v: %s", r, convert.err)
+			return rangeSet{}, convert.err
 		}
 
-		ips = append(ips, ipRange{rangeFrom: uint32(ipFrom), rangeTo: uint32(ipTo), data: int32(data)})
+		if len(ipTo) == net.IPv4len {
+			from := uint32(prevIP + 1)
+			if ipFrom != nil {
+				from = binary.BigEndian.Uint32(ipFrom)
+			}
+			to := binary.BigEndian.Uint32(ipTo)
+			if from > to {
+				mlog.Printf("error parsing %v: range ends before it starts", r)
+				return rangeSet{}, fmt.Errorf("bad range %v", r)
+			}
+			ips.v4 = append(ips.v4, ipRange{rangeFrom: from, rangeTo: to, data: int32(data)})
+			prevIP = int(to)
+		} else {
+			from := nextIP6
+			if ipFrom != nil {
+				from = uint128FromIP(ipFrom)
+			}
+			to := uint128FromIP(ipTo)
+			if to.less(from) {
+				mlog.Printf("error parsing %v: range ends before it starts", r)
+				return rangeSet{}, fmt.Errorf("bad range %v", r)
+			}
+			ips.v6 = append(ips.v6, ipRange6{rangeFrom: from, rangeTo: to, data: int32(data)})
+			nextIP6 = to.incr()
+		}
 	}
 
+	ips.table = values.table
+
 	return ips, nil
 }
 
@@ -222,17 +716,126 @@ func (c *converr) check(s string) int {
 	return i
 }
 
-func loadIPRanges(fname string, isbinary bool) (ipRangeList, error) {
+// addr parses an integer or dotted-quad IPv4 address into a 4-byte net.IP,
+// or a textual IPv6 address into a 16-byte net.IP
+func (c *converr) addr(s string) net.IP {
+	if strings.Contains(s, ":") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			c.err = fmt.Errorf("bad IPv6 address %q", s)
+		}
+		return ip
+	}
+
+	if strings.Contains(s, ".") {
+		ip := net.ParseIP(s).To4()
+		if ip == nil {
+			c.err = fmt.Errorf("bad IPv4 address %q", s)
+		}
+		return ip
+	}
+
+	i, e := strconv.ParseUint(s, 10, 32)
+	if e != nil {
+		c.err = e
+		return nil
+	}
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, uint32(i))
+	return ip
+}
+
+// cidr parses a CIDR prefix into its first and last addresses
+func (c *converr) cidr(s string) (net.IP, net.IP) {
+	_, ipnet, e := net.ParseCIDR(s)
+	if e != nil {
+		c.err = e
+		return nil, nil
+	}
+
+	from := ipnet.IP
+	if !strings.Contains(s, ":") {
+		from = from.To4()
+	}
+	to := make(net.IP, len(from))
+	for i := range from {
+		to[i] = from[i] | ^ipnet.Mask[len(ipnet.Mask)-len(from)+i]
+	}
+	return from, to
+}
+
+// gaps returns the number of unmapped gaps between consecutive ranges, and
+// the number of addresses they contain
+func (r ipRangeList) gaps() (int, uint64) {
+	var n int
+	var addrs uint64
+	for i := 1; i < len(r); i++ {
+		if r[i].rangeFrom > r[i-1].rangeTo && r[i].rangeFrom-r[i-1].rangeTo > 1 {
+			n++
+			addrs += uint64(r[i].rangeFrom - r[i-1].rangeTo - 1)
+		}
+	}
+	return n, addrs
+}
+
+// gaps returns the number of unmapped gaps between consecutive ranges
+func (r ipRange6List) gaps() int {
+	var n int
+	for i := 1; i < len(r); i++ {
+		if r[i-1].rangeTo.incr().less(r[i].rangeFrom) {
+			n++
+		}
+	}
+	return n
+}
+
+func loadIPRanges(fname string, isbinary bool) (rangeSet, error) {
 	file, err := os.Open(fname)
 	if err != nil {
 		mlog.Println("can't open file: ", fname, err)
-		return nil, err
+		return rangeSet{}, err
 	}
 
 	defer file.Close()
 	if isbinary {
-		return loadIPRangesFromBinary(bufio.NewReader(file))
+		ranges, info, err := readBinary(bufio.NewReader(file))
+		if err != nil {
+			return rangeSet{}, err
+		}
+		if info.Version > 1 {
+			mlog.Printf("loaded %d+%d ranges and %d values from %s (version %d, source %q, created %s)", info.Count, info.Count6, info.Values, fname, info.Version, info.Source, info.Created.Format(time.RFC3339))
+		}
+		return ranges, nil
+	}
+
+	ranges, err := loadIPRangesFromCSVColumns(file, csvColumns)
+	if err != nil {
+		return rangeSet{}, err
+	}
+
+	n, addrs := ranges.v4.gaps()
+	if n6 := ranges.v6.gaps(); n+n6 > 0 {
+		mlog.Printf("%s: %d IPv4 gaps (%d addresses) and %d IPv6 gaps left unmapped", fname, n, addrs, n6)
+	}
+
+	return ranges, nil
+}
+
+// loadRangeFile loads ranges from a CSV, binary or MaxMind DB file, detecting
+// the format from the file's contents and name
+func loadRangeFile(fname string) (rangeSet, error) {
+	if strings.HasSuffix(fname, ".mmdb") {
+		return loadIPRangesFromMMDB(fname)
+	}
+
+	file, err := os.Open(fname)
+	if err != nil {
+		return rangeSet{}, err
 	}
+	magic := make([]byte, len(magicBytes))
+	_, err = io.ReadFull(file, magic)
+	file.Close()
 
-	return loadIPRangesFromCSV(file)
+	isbinary := err == nil && (bytes.Equal(magic, magicBytes) || bytes.Equal(magic, magicBytesV2))
+	return loadIPRanges(fname, isbinary)
 }
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/binary"
+	"math/big"
+	"math/bits"
+	"net"
+	"sort"
+)
+
+// uint128 is an IPv6 address in host byte order
+type uint128 struct {
+	hi, lo uint64
+}
+
+func uint128FromIP(ip net.IP) uint128 {
+	ip = ip.To16()
+	return uint128{
+		hi: binary.BigEndian.Uint64(ip[:8]),
+		lo: binary.BigEndian.Uint64(ip[8:]),
+	}
+}
+
+// IP returns the address as a 16-byte net.IP
+func (u uint128) IP() net.IP {
+	ip := make(net.IP, net.IPv6len)
+	binary.BigEndian.PutUint64(ip[:8], u.hi)
+	binary.BigEndian.PutUint64(ip[8:], u.lo)
+	return ip
+}
+
+func (u uint128) less(v uint128) bool {
+	return u.hi < v.hi || (u.hi == v.hi && u.lo < v.lo)
+}
+
+func (u uint128) lessEq(v uint128) bool {
+	return !v.less(u)
+}
+
+func (u uint128) incr() uint128 {
+	lo := u.lo + 1
+	hi := u.hi
+	if lo == 0 {
+		hi++
+	}
+	return uint128{hi, lo}
+}
+
+func (u uint128) decr() uint128 {
+	lo := u.lo - 1
+	hi := u.hi
+	if u.lo == 0 {
+		hi--
+	}
+	return uint128{hi, lo}
+}
+
+func (u uint128) big() *big.Int {
+	b := new(big.Int).SetUint64(u.hi)
+	b.Lsh(b, 64)
+	return b.Or(b, new(big.Int).SetUint64(u.lo))
+}
+
+// rangeSize returns the number of addresses in from-to
+func rangeSize(from, to uint128) *big.Int {
+	n := to.big()
+	n.Sub(n, from.big())
+	return n.Add(n, big.NewInt(1))
+}
+
+func (u uint128) or(v uint128) uint128 {
+	return uint128{u.hi | v.hi, u.lo | v.lo}
+}
+
+// bit returns bit i of u, counting from the least significant bit
+func (u uint128) bit(i int) int {
+	if i < 64 {
+		return int(u.lo>>uint(i)) & 1
+	}
+	return int(u.hi>>uint(i-64)) & 1
+}
+
+func (u uint128) trailingZeros() int {
+	if u.lo != 0 {
+		return bits.TrailingZeros64(u.lo)
+	}
+	return 64 + bits.TrailingZeros64(u.hi)
+}
+
+// ones returns a uint128 with the low n bits set
+func ones(n int) uint128 {
+	switch {
+	case n <= 0:
+		return uint128{}
+	case n < 64:
+		return uint128{0, 1<<uint(n) - 1}
+	case n < 128:
+		return uint128{1<<uint(n-64) - 1, ^uint64(0)}
+	}
+	return uint128{^uint64(0), ^uint64(0)}
+}
+
+const ipRange6Size = 36
+
+type ipRange6 struct {
+	rangeFrom, rangeTo uint128
+	data               int32
+}
+
+type ipRange6List []ipRange6
+
+func (r ipRange6List) Len() int           { return len(r) }
+func (r ipRange6List) Less(i, j int) bool { return r[i].rangeTo.less(r[j].rangeTo) }
+func (r ipRange6List) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+
+// lookup returns the found value, if any, followed by a bool indicating whether the value was found
+func (r ipRange6List) lookup(ip uint128) (int32, bool) {
+	idx := sort.Search(len(r), func(i int) bool { return ip.lessEq(r[i].rangeTo) })
+
+	if idx < len(r) && r[idx].rangeFrom.lessEq(ip) && ip.lessEq(r[idx].rangeTo) {
+		return r[idx].data, true
+	}
+
+	return 0, false
+}
+
+// compact returns the list with adjacent ranges having the same value coalesced
+func (r ipRange6List) compact() ipRange6List {
+	if len(r) == 0 {
+		return r
+	}
+
+	out := ipRange6List{r[0]}
+	for _, v := range r[1:] {
+		last := &out[len(out)-1]
+		next := last.rangeTo.incr()
+		if last.data == v.data && next != (uint128{}) && next == v.rangeFrom {
+			last.rangeTo = v.rangeTo
+			continue
+		}
+		out = append(out, v)
+	}
+
+	return out
+}
+
+// rangeSet is the IPv4 and IPv6 ranges loaded from a single file
+type rangeSet struct {
+	v4    ipRangeList
+	v6    ipRange6List
+	table valueTable // table holds the values the ranges' data index, if any
+}
+
+func (s rangeSet) lookup(ip32 uint32) (int32, bool) { return s.v4.lookup(ip32) }
+func (s rangeSet) lookup6(ip uint128) (int32, bool) { return s.v6.lookup(ip) }
+func (s rangeSet) values() valueTable               { return s.table }
+func (s rangeSet) count() int                       { return len(s.v4) + len(s.v6) }
+
+func (s rangeSet) walk(fn4 func(ipRange), fn6 func(ipRange6)) {
+	for _, r := range s.v4 {
+		fn4(r)
+	}
+	for _, r := range s.v6 {
+		fn6(r)
+	}
+}
+
+func (s rangeSet) compact() rangeSet {
+	return rangeSet{v4: s.v4.compact(), v6: s.v6.compact(), table: s.table}
+}
+
+func putRange6(b []byte, r ipRange6) {
+	binary.LittleEndian.PutUint64(b[0:], r.rangeFrom.hi)
+	binary.LittleEndian.PutUint64(b[8:], r.rangeFrom.lo)
+	binary.LittleEndian.PutUint64(b[16:], r.rangeTo.hi)
+	binary.LittleEndian.PutUint64(b[24:], r.rangeTo.lo)
+	binary.LittleEndian.PutUint32(b[32:], uint32(r.data))
+}
+
+func getRange6(b []byte) ipRange6 {
+	return ipRange6{
+		rangeFrom: uint128{binary.LittleEndian.Uint64(b[0:]), binary.LittleEndian.Uint64(b[8:])},
+		rangeTo:   uint128{binary.LittleEndian.Uint64(b[16:]), binary.LittleEndian.Uint64(b[24:])},
+		data:      int32(binary.LittleEndian.Uint32(b[32:])),
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"sort"
+	"syscall"
+)
+
+// mmapRangeList is a range list backed by a memory-mapped binary file.
+// Lookups binary search the records in place, so loading costs nothing more
+// than mapping the file, and the pages are shared with other processes
+// mapping the same file.
+type mmapRangeList struct {
+	mapping  []byte // mapping is the entire mapped file
+	records  []byte // records are the ipRangeSize-byte IPv4 ranges within mapping
+	records6 []byte // records6 are the ipRange6Size-byte IPv6 ranges within mapping
+	table    valueTable
+	info     binaryInfo
+}
+
+// openMmapRanges maps a version 1 or version 2 binary file.  The checksum of
+// a version 2 file is verified before it is returned.
+func openMmapRanges(fname string) (*mmapRangeList, error) {
+	file, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	fi, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	size := fi.Size()
+	if size < int64(len(magicBytes)) || int64(int(size)) != size {
+		return nil, fmt.Errorf("%s: bad file size %d", fname, size)
+	}
+
+	mapping, err := syscall.Mmap(int(file.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, fmt.Errorf("%s: mmap failed: %v", fname, err)
+	}
+
+	m := &mmapRangeList{mapping: mapping}
+	if err := m.parse(); err != nil {
+		m.Close()
+		return nil, fmt.Errorf("%s: %v", fname, err)
+	}
+
+	return m, nil
+}
+
+func (m *mmapRangeList) parse() error {
+	magic := m.mapping[:len(magicBytes)]
+	r := bytes.NewReader(m.mapping[len(magic):])
+
+	var footer []byte
+	switch {
+	case bytes.Equal(magic, magicBytes):
+		var count uint32
+		if err := binary.Read(r, binary.LittleEndian, &count); err != nil {
+			return fmt.Errorf("can't read file size field %s", err)
+		}
+		m.info = binaryInfo{Version: 1, Count: count}
+		footer = magicBytes
+	case bytes.Equal(magic, magicBytesV2):
+		info, err := readHeaderV2(r)
+		if err != nil {
+			return err
+		}
+		m.info = info
+		footer = magicBytesV2
+	default:
+		return fmt.Errorf("file format is incorrect, expected header '%s' or '%s', actual '%s'", magicBytes, magicBytesV2, magic)
+	}
+
+	start := len(m.mapping) - r.Len()
+	end := start + int(m.info.Count)*ipRangeSize
+
+	trailer := len(footer)
+	if m.info.Version > 1 {
+		trailer += 4 // checksum
+	}
+
+	// the checksum covers everything up to the trailer, so verifying it
+	// first means the counts and value table below come from intact data
+	if start+trailer > len(m.mapping) {
+		return fmt.Errorf("file size is %d bytes, too short for its header", len(m.mapping))
+	}
+	if m.info.Version > 1 {
+		checked := len(m.mapping) - trailer
+		sum := crc32.Update(0, crcTable, m.mapping[len(magic):checked])
+		if err := checkChecksum(sum, m.mapping[checked:]); err != nil {
+			return err
+		}
+	}
+
+	if end+trailer > len(m.mapping) {
+		return fmt.Errorf("expected %d items, file size is %d bytes", m.info.Count, len(m.mapping))
+	}
+	m.records = m.mapping[start:end]
+
+	if m.info.Version >= 3 {
+		if end+4+trailer > len(m.mapping) {
+			return fmt.Errorf("can't read IPv6 size field")
+		}
+		m.info.Count6 = binary.LittleEndian.Uint32(m.mapping[end:])
+		start, end = end+4, end+4+int(m.info.Count6)*ipRange6Size
+		if end+trailer > len(m.mapping) {
+			return fmt.Errorf("expected %d IPv6 items, file size is %d bytes", m.info.Count6, len(m.mapping))
+		}
+		m.records6 = m.mapping[start:end]
+	}
+
+	if m.info.Version >= 4 {
+		// the value table is small and variable-length, so it's decoded up front
+		tr := bytes.NewReader(m.mapping[end : len(m.mapping)-trailer])
+		table, err := readValueTable(tr)
+		if err != nil {
+			return err
+		}
+		m.table = table
+		m.info.Values = uint32(len(table))
+		end = len(m.mapping) - trailer - tr.Len()
+	}
+
+	if end+trailer != len(m.mapping) {
+		return fmt.Errorf("unexpected %d bytes of trailing data", len(m.mapping)-end-trailer)
+	}
+
+	if !bytes.Equal(m.mapping[len(m.mapping)-len(footer):], footer) {
+		return fmt.Errorf("file format is incorrect, expected footer '%s', actual '%s'", footer, m.mapping[len(m.mapping)-len(footer):])
+	}
+
+	return nil
+}
+
+// Len returns the number of ranges in the file
+func (m *mmapRangeList) Len() int { return len(m.records) / ipRangeSize }
+
+// at decodes the i'th range
+func (m *mmapRangeList) at(i int) ipRange {
+	b := m.records[i*ipRangeSize:]
+	return ipRange{
+		binary.LittleEndian.Uint32(b[0:]),
+		binary.LittleEndian.Uint32(b[4:]),
+		int32(binary.LittleEndian.Uint32(b[8:])),
+	}
+}
+
+// lookup returns the found value, if any, followed by a bool indicating whether the value was found
+func (m *mmapRangeList) lookup(ip32 uint32) (int32, bool) {
+	n := m.Len()
+	idx := sort.Search(n, func(i int) bool {
+		return ip32 <= binary.LittleEndian.Uint32(m.records[i*ipRangeSize+4:])
+	})
+
+	if idx < n {
+		r := m.at(idx)
+		if r.rangeFrom <= ip32 && ip32 <= r.rangeTo {
+			return r.data, true
+		}
+	}
+
+	return 0, false
+}
+
+// lookup6 is lookup for IPv6 addresses
+func (m *mmapRangeList) lookup6(ip uint128) (int32, bool) {
+	n := len(m.records6) / ipRange6Size
+	idx := sort.Search(n, func(i int) bool {
+		b := m.records6[i*ipRange6Size+16:]
+		to := uint128{binary.LittleEndian.Uint64(b[0:]), binary.LittleEndian.Uint64(b[8:])}
+		return ip.lessEq(to)
+	})
+
+	if idx < n {
+		r := getRange6(m.records6[idx*ipRange6Size:])
+		if r.rangeFrom.lessEq(ip) && ip.lessEq(r.rangeTo) {
+			return r.data, true
+		}
+	}
+
+	return 0, false
+}
+
+func (m *mmapRangeList) values() valueTable { return m.table }
+func (m *mmapRangeList) count() int         { return m.Len() + len(m.records6)/ipRange6Size }
+
+func (m *mmapRangeList) walk(fn4 func(ipRange), fn6 func(ipRange6)) {
+	for i := 0; i < m.Len(); i++ {
+		fn4(m.at(i))
+	}
+	for i := 0; i < len(m.records6); i += ipRange6Size {
+		fn6(getRange6(m.records6[i:]))
+	}
+}
+
+// Close unmaps the file.  The list must not be used afterwards.
+func (m *mmapRangeList) Close() error {
+	if m.mapping == nil {
+		return nil
+	}
+	err := syscall.Munmap(m.mapping)
+	m.mapping, m.records, m.records6 = nil, nil, nil
+	return err
+}
@@ -1,10 +1,16 @@
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
 	"io/ioutil"
 	"math/rand"
+	"net"
 	"os"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestWriteBinaryAndReadAgain(t *testing.T) {
@@ -24,13 +30,20 @@ func TestWriteBinaryAndReadAgain(t *testing.T) {
 
 	t.Logf("filename %s", tempFile.Name())
 	defer os.Remove(tempFile.Name())
-	writeBinary(tempFile, want)
+	created := time.Date(2016, 5, 4, 3, 2, 1, 0, time.UTC)
+	writeBinary(tempFile, rangeSet{v4: want}, binaryInfo{Created: created, Source: "GeoIPRange_dump.csv"})
 	tempFile.Seek(0, 0)
-	actual, err := loadIPRangesFromBinary(tempFile)
+	set, info, err := readBinary(tempFile)
 	if err != nil {
 		t.Errorf("couldn't load %s: %s", tempFile.Name(), err)
 		return
 	}
+	actual := set.v4
+
+	wantInfo := binaryInfo{Version: binaryVersion, Created: created, Source: "GeoIPRange_dump.csv", Count: uint32(len(want))}
+	if info != wantInfo {
+		t.Errorf("header mismatch: want %+v, got %+v", wantInfo, info)
+	}
 
 	if len(want) != len(actual) {
 		t.Errorf("length of input and output arrays is different, want %d, got %d", len(want), len(actual))
@@ -45,6 +58,310 @@ func TestWriteBinaryAndReadAgain(t *testing.T) {
 	}
 }
 
+func TestReadBinaryV1(t *testing.T) {
+	want := []ipRange{
+		{0, 387534208, 0},
+		{387534209, 387534209, 20107093},
+		{387534210, 387534210, 20107094},
+	}
+
+	var buf bytes.Buffer
+	buf.Write(magicBytes)
+	binary.Write(&buf, binary.LittleEndian, uint32(len(want)))
+	for _, r := range want {
+		binary.Write(&buf, binary.LittleEndian, []uint32{r.rangeFrom, r.rangeTo, uint32(r.data)})
+	}
+	buf.Write(magicBytes)
+
+	actual, info, err := readBinary(&buf)
+	if err != nil {
+		t.Fatalf("couldn't load v1 file: %s", err)
+	}
+
+	if info.Version != 1 || info.Count != uint32(len(want)) {
+		t.Errorf("unexpected header %+v", info)
+	}
+
+	if !reflect.DeepEqual(ipRangeList(want), actual.v4) {
+		t.Errorf("want %v, got %v", want, actual)
+	}
+}
+
+func TestReadBinaryCorrupt(t *testing.T) {
+	ranges := []ipRange{
+		{0, 387534208, 0},
+		{387534209, 387534209, 20107093},
+		{387534210, 387534210, 20107094},
+	}
+
+	var buf bytes.Buffer
+	if err := writeBinary(&buf, rangeSet{v4: ranges}, binaryInfo{Created: time.Now(), Source: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	good := buf.Bytes()
+
+	// flip a bit in the data field of the last record
+	corrupt := append([]byte(nil), good...)
+	corrupt[len(corrupt)-len(magicBytesV2)-4-1] ^= 0x01
+	if _, _, err := readBinary(bytes.NewReader(corrupt)); err == nil {
+		t.Errorf("expected checksum error for corrupted file")
+	}
+
+	// drop half of the last record
+	truncated := append([]byte(nil), good[:len(good)-len(magicBytesV2)-4-ipRangeSize/2]...)
+	if _, _, err := readBinary(bytes.NewReader(truncated)); err == nil {
+		t.Errorf("expected error for truncated file")
+	}
+
+	// a huge count must fail when the input runs out, not allocate it all
+	huge := append([]byte(nil), good...)
+	binary.LittleEndian.PutUint32(huge[len(magicBytesV2)+4+8+4+len("test"):], 0xffffffff)
+	if _, _, err := readBinary(bytes.NewReader(huge)); err == nil {
+		t.Errorf("expected error for corrupted count")
+	}
+
+	hugeV1 := append(append([]byte(nil), magicBytes...), 0xff, 0xff, 0xff, 0xff)
+	if _, _, err := readBinary(bytes.NewReader(hugeV1)); err == nil {
+		t.Errorf("expected error for corrupted v1 count")
+	}
+}
+
+func TestIPv6Ranges(t *testing.T) {
+	csv := `16777215,0
+16777471,100
+2001:db7:ffff:ffff:ffff:ffff:ffff:ffff,0
+2001:db8::ff,200
+2001:db8::ffff,201
+`
+	set, err := loadIPRangesFromCSV(strings.NewReader(csv))
+	if err != nil {
+		t.Fatalf("couldn't parse CSV: %s", err)
+	}
+
+	if len(set.v4) != 2 || len(set.v6) != 3 {
+		t.Fatalf("want 2+3 ranges, got %d+%d", len(set.v4), len(set.v6))
+	}
+
+	var buf bytes.Buffer
+	if err := writeBinary(&buf, set, binaryInfo{Created: time.Now(), Source: "test"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tempFile, err := ioutil.TempFile("", "rgipBinary6")
+	if err != nil {
+		t.Fatalf("couldn't create temp file")
+	}
+	defer os.Remove(tempFile.Name())
+	tempFile.Write(buf.Bytes())
+	tempFile.Close()
+
+	loaded, info, err := readBinary(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("couldn't load binary: %s", err)
+	}
+	if info.Count != 2 || info.Count6 != 3 {
+		t.Errorf("unexpected header %+v", info)
+	}
+	if !reflect.DeepEqual(set, loaded) {
+		t.Errorf("want %v, got %v", set, loaded)
+	}
+
+	// a corrupt IPv6 count must fail when the input runs out, not allocate it all
+	huge := append([]byte(nil), buf.Bytes()...)
+	binary.LittleEndian.PutUint32(huge[len(magicBytesV2)+4+8+4+len("test")+4+2*ipRangeSize:], 0xffffffff)
+	if _, _, err := readBinary(bytes.NewReader(huge)); err == nil {
+		t.Errorf("expected error for corrupted IPv6 count")
+	}
+
+	m, err := openMmapRanges(tempFile.Name())
+	if err != nil {
+		t.Fatalf("couldn't map binary: %s", err)
+	}
+	defer m.Close()
+
+	tests := []struct {
+		ip   string
+		data int32
+		ok   bool
+	}{
+		{"1.0.0.1", 100, true},
+		{"1.0.1.0", 0, false},
+		{"2001:db8::", 200, true},
+		{"2001:db8::ff", 200, true},
+		{"2001:db8::100", 201, true},
+		{"2001:db8::1:0", 0, false},
+	}
+
+	for _, lookuper := range []rangeLookuper{set, loaded, m} {
+		for _, tt := range tests {
+			ip := net.ParseIP(tt.ip)
+			var data int32
+			var ok bool
+			if ip4 := ip.To4(); ip4 != nil {
+				data, ok = lookuper.lookup(binary.BigEndian.Uint32(ip4))
+			} else {
+				data, ok = lookuper.lookup6(uint128FromIP(ip))
+			}
+			if data != tt.data || ok != tt.ok {
+				t.Errorf("%T: lookup(%s)=(%d, %v), want (%d, %v)", lookuper, tt.ip, data, ok, tt.data, tt.ok)
+			}
+		}
+	}
+}
+
+func TestExplicitCSV(t *testing.T) {
+	csv := `1.0.0.0,1.0.0.255,100
+16777472,16777727,101
+1.0.4.0/22,102
+1.0.8.255,103
+2001:db8::,2001:db8::ffff,200
+2001:db8:1::/48,201
+`
+	set, err := loadIPRangesFromCSV(strings.NewReader(csv))
+	if err != nil {
+		t.Fatalf("couldn't parse CSV: %s", err)
+	}
+
+	want := rangeSet{
+		v4: ipRangeList{
+			{0x01000000, 0x010000ff, 100},
+			{0x01000100, 0x010001ff, 101},
+			{0x01000400, 0x010007ff, 102},
+			{0x01000800, 0x010008ff, 103},
+		},
+		v6: ipRange6List{
+			{uint128{0x20010db8 << 32, 0}, uint128{0x20010db8 << 32, 0xffff}, 200},
+			{uint128{0x20010db8<<32 | 1<<16, 0}, uint128{0x20010db8<<32 | 1<<16 | 0xffff, ^uint64(0)}, 201},
+		},
+	}
+
+	if !reflect.DeepEqual(set, want) {
+		t.Errorf("got %v, want %v", set, want)
+	}
+
+	if n, addrs := set.v4.gaps(); n != 1 || addrs != 512 {
+		t.Errorf("v4 gaps=(%d, %d), want (1, 512)", n, addrs)
+	}
+
+	if n := set.v6.gaps(); n != 1 {
+		t.Errorf("v6 gaps=%d, want 1", n)
+	}
+
+	// the gap stays unmapped
+	if _, ok := set.lookup(0x01000200); ok {
+		t.Errorf("found a value in the gap")
+	}
+
+	for _, bad := range []string{
+		"1.0.0.255,1.0.0.0,1\n",
+		"1.0.0.0,2001:db8::,1\n",
+		"1.0.0.0/33,1\n",
+		"1.0.0.300,1\n",
+		"1\n",
+	} {
+		if _, err := loadIPRangesFromCSV(strings.NewReader(bad)); err == nil {
+			t.Errorf("expected error parsing %q", bad)
+		}
+	}
+}
+
+func TestCompact(t *testing.T) {
+	set := rangeSet{
+		v4: ipRangeList{
+			{0, 387534208, 0},
+			{387534209, 387534209, 20107093},
+			{387534210, 387534210, 20107093},
+			{387534211, 387534211, 20107093},
+			{387534212, 387534212, 20107096},
+			{387534214, 387534214, 20107096}, // not adjacent
+			{387534215, 4294967295, 20107096},
+		},
+		v6: ipRange6List{
+			{uint128{0, 0}, uint128{0, 0xff}, 1},
+			{uint128{0, 0x100}, uint128{1, 0}, 1},
+			{uint128{1, 1}, uint128{1, 2}, 2},
+		},
+	}
+
+	want := rangeSet{
+		v4: ipRangeList{
+			{0, 387534208, 0},
+			{387534209, 387534211, 20107093},
+			{387534212, 387534212, 20107096},
+			{387534214, 4294967295, 20107096},
+		},
+		v6: ipRange6List{
+			{uint128{0, 0}, uint128{1, 0}, 1},
+			{uint128{1, 1}, uint128{1, 2}, 2},
+		},
+	}
+
+	got := set.compact()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("compact()=%v, want %v", got, want)
+	}
+
+	// the input is left alone
+	if len(set.v4) != 7 || len(set.v6) != 3 {
+		t.Errorf("compact modified its input")
+	}
+}
+
+func TestMmapLookup(t *testing.T) {
+	rand.Seed(0)
+
+	var ranges ipRangeList
+	var from uint32
+	for from < 0xf0000000 {
+		to := from + uint32(rand.Intn(1<<20))
+		ranges = append(ranges, ipRange{from, to, rand.Int31()})
+		// leave the occasional gap
+		from = to + 1 + uint32(rand.Intn(2))*uint32(rand.Intn(1<<16))
+	}
+
+	for _, version := range []int{1, 2} {
+		tempFile, err := ioutil.TempFile("", "rgipMmap")
+		if err != nil {
+			t.Fatalf("couldn't create temp file")
+		}
+		defer os.Remove(tempFile.Name())
+
+		if version == 1 {
+			tempFile.Write(magicBytes)
+			binary.Write(tempFile, binary.LittleEndian, uint32(len(ranges)))
+			for _, r := range ranges {
+				binary.Write(tempFile, binary.LittleEndian, []uint32{r.rangeFrom, r.rangeTo, uint32(r.data)})
+			}
+			tempFile.Write(magicBytes)
+		} else {
+			writeBinary(tempFile, rangeSet{v4: ranges}, binaryInfo{Created: time.Now(), Source: "test"})
+		}
+		tempFile.Close()
+
+		m, err := openMmapRanges(tempFile.Name())
+		if err != nil {
+			t.Fatalf("v%d: couldn't map %s: %s", version, tempFile.Name(), err)
+		}
+
+		if m.Len() != len(ranges) {
+			t.Errorf("v%d: want %d items, got %d", version, len(ranges), m.Len())
+		}
+
+		for i := 0; i < 100000; i++ {
+			ip := uint32(rand.Int63())
+			wantData, wantOk := ranges.lookup(ip)
+			data, ok := m.lookup(ip)
+			if data != wantData || ok != wantOk {
+				t.Fatalf("v%d: lookup(%d): want (%d, %v), got (%d, %v)", version, ip, wantData, wantOk, data, ok)
+			}
+		}
+
+		if err := m.Close(); err != nil {
+			t.Errorf("v%d: close failed: %s", version, err)
+		}
+	}
+}
+
 func BenchmarkFileLoad(b *testing.B) {
 	for n := 0; n < b.N; n++ {
 		fname := "maxmind/GeoIPRange_dump.csv.bin"
@@ -53,9 +370,24 @@ func BenchmarkFileLoad(b *testing.B) {
 			b.Errorf("couldn't load %s: %s", fname, err)
 		}
 
-		if len(ranges) < 1000 {
-			b.Errorf("loaded only %d entries", len(ranges))
+		if len(ranges.v4) < 1000 {
+			b.Errorf("loaded only %d entries", len(ranges.v4))
+		}
+	}
+}
+
+func BenchmarkMmapLoad(b *testing.B) {
+	for n := 0; n < b.N; n++ {
+		fname := "maxmind/GeoIPRange_dump.csv.bin"
+		ranges, err := openMmapRanges(fname)
+		if err != nil {
+			b.Fatalf("couldn't map %s: %s", fname, err)
+		}
+
+		if ranges.Len() < 1000 {
+			b.Errorf("loaded only %d entries", ranges.Len())
 		}
+		ranges.Close()
 	}
 }
 
@@ -86,7 +418,7 @@ func TestNormalLookup(t *testing.T) {
 		t.Errorf("couldn't load %s: %s", fname, err)
 	}
 
-	t.Log("normal size=", len(ranges))
+	t.Log("normal size=", len(ranges.v4))
 
 	rand.Seed(0)
 	total = 0
@@ -105,7 +437,7 @@ func TestShardedLookup(t *testing.T) {
 		t.Errorf("couldn't load %s: %s", fname, err)
 	}
 
-	shards, err := ranges.shard()
+	shards, err := ranges.v4.shard()
 	if err != nil {
 		panic(err)
 	}
@@ -127,6 +459,44 @@ func TestShardedLookup(t *testing.T) {
 	t.Log("total", total)
 }
 
+func TestShardedRangeSet(t *testing.T) {
+	set := rangeSet{
+		v4: ipRangeList{
+			{0, 0x00ffffff, 1},
+			{0x01000000, 0x0200ffff, 2}, // spans two shards
+			{0x02010000, 0x02ffffff, 3},
+			{0x05000000, 0x05000fff, 5},
+		},
+		v6: ipRange6List{
+			{uint128{0x20010db8 << 32, 0}, uint128{0x20010db8<<32 | 0xffffffff, ^uint64(0)}, 6},
+		},
+	}
+
+	sharded, err := set.shard()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st := sharded.v4.stats()
+	if want := (shardStats{Shards: 4, Ranges: 5, Largest: 2, Octet: 2}); st != want {
+		t.Errorf("stats=%+v, want %+v", st, want)
+	}
+
+	rand.Seed(0)
+	for i := 0; i < 100000; i++ {
+		ip := uint32(rand.Int63()) & 0x07ffffff
+		wantData, wantOk := set.lookup(ip)
+		data, ok := sharded.lookup(ip)
+		if data != wantData || ok != wantOk {
+			t.Fatalf("lookup(%08x)=(%d, %v), want (%d, %v)", ip, data, ok, wantData, wantOk)
+		}
+	}
+
+	if data, ok := sharded.lookup6(uint128{0x20010db8 << 32, 1}); data != 6 || !ok {
+		t.Errorf("lookup6=(%d, %v), want (6, true)", data, ok)
+	}
+}
+
 func randomIP() uint32 {
 	ip := uint32(rand.Int63())
 	if ip&0xff000000 > 0xdf000000 {
@@ -142,7 +512,7 @@ func BenchmarkShardedLookup(b *testing.B) {
 		b.Errorf("couldn't load %s: %s", fname, err)
 	}
 
-	shards, err := ranges.shard()
+	shards, err := ranges.v4.shard()
 	if err != nil {
 		panic(err)
 	}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"time"
+
+	"github.com/peterbourgon/g2g"
+)
+
+// latencyWindow is how often the latency windows are rotated.  It matches
+// the graphite reporting interval, so each report covers the last window.
+const latencyWindow = 60 * time.Second
+
+// handlerNames are the handlers whose latency is reported.  Each handler
+// wrapped by instrument must be listed.
+var handlerNames = []string{
+	"lookup", "lookups", "lookups_post", "stream", "ufi", "lookup2", "lookups2",
+	"metrics", "healthz", "readyz", "admin_reload", "admin_data",
+}
+
+// backendNames are the databases whose lookup latency is reported.  The
+// .dat databases are looked up by libGeoIP through cgo, the rest in Go.
+var backendNames = []string{"netspeed", "isp", "ufi", "ufi_mmdb", "city", "geoip2"}
+
+// timeBackend records the time taken by a database lookup started at t0
+func timeBackend(db string, t0 time.Time) {
+	prom.backends.observe(time.Since(t0).Seconds(), db)
+}
+
+// latencyStats summarizes a latency histogram, in milliseconds
+type latencyStats struct {
+	Count  uint64  `json:"count"`
+	MeanMs float64 `json:"mean_ms"`
+	P50Ms  float64 `json:"p50_ms"`
+	P90Ms  float64 `json:"p90_ms"`
+	P99Ms  float64 `json:"p99_ms"`
+}
+
+func (h *histogram) stats() latencyStats {
+	st := latencyStats{
+		Count: h.count,
+		P50Ms: h.quantile(0.5) * 1000,
+		P90Ms: h.quantile(0.9) * 1000,
+		P99Ms: h.quantile(0.99) * 1000,
+	}
+	if h.count > 0 {
+		st.MeanMs = h.sum / float64(h.count) * 1000
+	}
+	return st
+}
+
+// latencySummary is the latency since startup and over the last window
+type latencySummary struct {
+	Total      latencyStats `json:"total"`
+	LastWindow latencyStats `json:"last_window"`
+}
+
+func summarize(h *histogramVec, names []string) map[string]latencySummary {
+	m := make(map[string]latencySummary, len(names))
+	for _, name := range names {
+		total, window := h.get(name)
+		m[name] = latencySummary{Total: total.stats(), LastWindow: window.stats()}
+	}
+	return m
+}
+
+// latencyVar is the expvar representation of the handler and database latencies
+func latencyVar() interface{} {
+	return map[string]interface{}{
+		"handlers": summarize(prom.latency, handlerNames),
+		"backends": summarize(prom.backends, backendNames),
+	}
+}
+
+// rotateLatencyWindows starts a new latency window every latencyWindow
+func rotateLatencyWindows() {
+	for range time.Tick(latencyWindow) {
+		prom.latency.rotate()
+		prom.backends.rotate()
+	}
+}
+
+// registerLatency registers the last window's latency statistics for each
+// handler and database with graphite, under prefix
+func registerLatency(graphite *g2g.Graphite, prefix string) {
+	register := func(kind string, h *histogramVec, names []string) {
+		for _, name := range names {
+			name := name
+			stat := func(f func(latencyStats) interface{}) expvar.Var {
+				return expvar.Func(func() interface{} {
+					_, window := h.get(name)
+					return f(window.stats())
+				})
+			}
+			p := fmt.Sprintf("%s.%s.%s", prefix, kind, name)
+			graphite.Register(p+".count", stat(func(st latencyStats) interface{} { return st.Count }))
+			graphite.Register(p+".mean_ms", stat(func(st latencyStats) interface{} { return st.MeanMs }))
+			graphite.Register(p+".p50_ms", stat(func(st latencyStats) interface{} { return st.P50Ms }))
+			graphite.Register(p+".p99_ms", stat(func(st latencyStats) interface{} { return st.P99Ms }))
+		}
+	}
+	register("handlers", prom.latency, handlerNames)
+	register("backends", prom.backends, backendNames)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// selectColumns returns the fields named in a comma-separated list, or all
+// of them if the list is empty
+func selectColumns(names string) ([]ipinfoField, error) {
+	if names == "" {
+		return ipinfoFields, nil
+	}
+	return selectIPInfoFields(names)
+}
+
+// ipinfoWriter writes lookup results in one of the formats:
+//
+//	json   a JSON object per line
+//	tsv    a header row then tab-separated fields
+//	table  aligned columns, written when the writer is flushed
+type ipinfoWriter struct {
+	w      *bufio.Writer
+	tw     *tabwriter.Writer
+	cols   []ipinfoField
+	fields fieldSet // fields are the parts of IPInfo looked up
+	encode func(IPInfo) error
+}
+
+func newIPInfoWriter(out io.Writer, format string, cols []ipinfoField) (*ipinfoWriter, error) {
+	iw := &ipinfoWriter{w: bufio.NewWriter(out), cols: cols, fields: fieldsOf(cols)}
+
+	switch format {
+	case "json":
+		iw.fields = allFields
+		encoder := json.NewEncoder(iw.w)
+		iw.encode = func(ipinfo IPInfo) error { return encoder.Encode(ipinfo) }
+	case "tsv":
+		iw.encode = iw.row(iw.w)
+	case "table":
+		iw.tw = tabwriter.NewWriter(iw.w, 0, 8, 2, ' ', 0)
+		iw.encode = iw.row(iw.tw)
+	default:
+		return nil, fmt.Errorf("unknown output format %q", format)
+	}
+
+	if format != "json" {
+		var names []string
+		for _, c := range cols {
+			names = append(names, c.name)
+		}
+		w := io.Writer(iw.w)
+		if iw.tw != nil {
+			w = iw.tw
+		}
+		if _, err := fmt.Fprintln(w, strings.Join(names, "\t")); err != nil {
+			return nil, err
+		}
+	}
+
+	return iw, nil
+}
+
+// row returns a function writing the columns of an IPInfo to w
+func (iw *ipinfoWriter) row(w io.Writer) func(IPInfo) error {
+	return func(ipinfo IPInfo) error {
+		fields := make([]string, len(iw.cols))
+		for i, c := range iw.cols {
+			// keep each record on one line
+			fields[i] = strings.Map(func(r rune) rune {
+				if r == '\t' || r == '\n' || r == '\r' {
+					return ' '
+				}
+				return r
+			}, c.text(&ipinfo))
+		}
+		_, err := fmt.Fprintln(w, strings.Join(fields, "\t"))
+		return err
+	}
+}
+
+func (iw *ipinfoWriter) write(ipinfo IPInfo) error {
+	return iw.encode(ipinfo)
+}
+
+// flush writes out any buffered output.  Table output is only aligned over
+// the rows written since the last flush, so is only flushed at the end.
+func (iw *ipinfoWriter) flush(final bool) error {
+	if iw.tw != nil {
+		if !final {
+			return nil
+		}
+		if err := iw.tw.Flush(); err != nil {
+			return err
+		}
+	}
+	return iw.w.Flush()
+}
+
+// lookupAddrs looks up each address in gen, writing the results to iw.  It
+// returns the number of addresses which couldn't be parsed.
+func lookupAddrs(gen *generation, iw *ipinfoWriter, addrs []string) (int, error) {
+	var bad int
+	for _, ip := range addrs {
+		ipinfo, err := gen.lookupIPInfoFields(ip, iw.fields)
+		if err != nil {
+			ipinfo = IPInfo{IP: ip, IPStatus: "ParseError"}
+			bad++
+		} else {
+			ipinfo.IPStatus = "OK"
+		}
+		if err := iw.write(ipinfo); err != nil {
+			return bad, err
+		}
+	}
+	return bad, nil
+}
+
+// lookupReader looks up the address on each line of r, flushing output
+// whenever no more input is buffered so interactive use sees each result as
+// it's entered.
+func lookupReader(gen *generation, iw *ipinfoWriter, r io.Reader) (int, error) {
+	br := bufio.NewReader(r)
+	var bad int
+	for {
+		if br.Buffered() == 0 {
+			if err := iw.flush(false); err != nil {
+				return bad, err
+			}
+		}
+
+		line, err := br.ReadString('\n')
+		if ip := strings.TrimSpace(line); ip != "" {
+			n, werr := lookupAddrs(gen, iw, []string{ip})
+			bad += n
+			if werr != nil {
+				return bad, werr
+			}
+		}
+
+		if err == io.EOF {
+			return bad, nil
+		}
+		if err != nil {
+			return bad, err
+		}
+	}
+}
+
+// lookupMain implements the lookup command, looking up addresses given as
+// arguments, or one per line on stdin, in the data files of config
+func lookupMain(config dataConfig, args []string) int {
+	fs := flag.NewFlagSet("lookup", flag.ExitOnError)
+	format := fs.String("format", "json", "output format: json, tsv or table")
+	fields := fs.String("fields", "", "comma-separated fields for tsv and table output (default all)")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: rgip [data flags] lookup [flags] [address ...]")
+		fmt.Fprintln(os.Stderr, "addresses are read one per line from stdin if none are given")
+		fmt.Fprintln(os.Stderr, "fields:", strings.Join(fieldNames(), ","))
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	cols, err := selectColumns(*fields)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	iw, err := newIPInfoWriter(os.Stdout, *format, cols)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	results, err := loadDataFiles(config)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error loading data files:", err)
+		for _, r := range results {
+			if !r.OK {
+				fmt.Fprintf(os.Stderr, "unable to load %s: %s\n", r.Path, r.Error)
+			}
+		}
+		return 1
+	}
+
+	gen := acquireGeneration()
+	defer gen.release()
+
+	var bad int
+	if fs.NArg() == 0 || (fs.NArg() == 1 && fs.Arg(0) == "-") {
+		bad, err = lookupReader(gen, iw, os.Stdin)
+	} else {
+		bad, err = lookupAddrs(gen, iw, fs.Args())
+	}
+	if err == nil {
+		err = iw.flush(true)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "lookup failed:", err)
+		return 1
+	}
+
+	if bad > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestSelectColumns(t *testing.T) {
+	cols, err := selectColumns("ip, ufi,country_code")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, c := range cols {
+		names = append(names, c.name)
+	}
+	if got := strings.Join(names, ","); got != "ip,ufi,country_code" {
+		t.Errorf("selectColumns=%s", got)
+	}
+
+	if cols, _ := selectColumns(""); len(cols) != len(ipinfoFields) {
+		t.Errorf("selectColumns(\"\") returned %d columns, want all %d", len(cols), len(ipinfoFields))
+	}
+	if _, err := selectColumns("ip,bogus"); err == nil {
+		t.Errorf("expected error for unknown field")
+	}
+}
+
+func TestLookupOutput(t *testing.T) {
+	gen := testGeneration()
+
+	cols, _ := selectColumns("ip,ip_status,ufi,country_code")
+
+	for _, tt := range []struct {
+		format string
+		want   string
+	}{
+		{"tsv", "ip\tip_status\tufi\tcountry_code\n1.2.3.4\tOK\t7\t\nbogus\tParseError\t0\t\n"},
+		{"table", "ip       ip_status   ufi  country_code\n1.2.3.4  OK          7    \nbogus    ParseError  0    \n"},
+		{"json", `{"ip":"1.2.3.4","isp":"","netspeed":"","ufi":{"guessed_ufi":7},"ip_status":"OK"}` + "\n" +
+			`{"ip":"bogus","isp":"","netspeed":"","ufi":{"guessed_ufi":0},"ip_status":"ParseError"}` + "\n"},
+	} {
+		var out bytes.Buffer
+		iw, err := newIPInfoWriter(&out, tt.format, cols)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bad, err := lookupReader(gen, iw, strings.NewReader("1.2.3.4\n\n bogus \n"))
+		if err == nil {
+			err = iw.flush(true)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bad != 1 {
+			t.Errorf("%s: %d bad addresses, want 1", tt.format, bad)
+		}
+		if out.String() != tt.want {
+			t.Errorf("%s output:\n%q\nwant:\n%q", tt.format, out.String(), tt.want)
+		}
+	}
+
+	if _, err := newIPInfoWriter(new(bytes.Buffer), "xml", cols); err == nil {
+		t.Errorf("expected error for unknown format")
+	}
+}
+
+func TestLookupUFIAttributes(t *testing.T) {
+	gen := &generation{ufis: new(ipRanges)}
+	gen.ufis.swap(rangeSet{
+		v4:    ipRangeList{{0x01020300, 0x010203ff, 0}},
+		table: valueTable{{UFI: 7, Confidence: 0.5, Source: "survey", Label: "office"}},
+	})
+
+	cols, err := selectColumns("ip,ufi,confidence,source,label,region_name")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	iw, _ := newIPInfoWriter(&out, "tsv", cols)
+	if _, err := lookupAddrs(gen, iw, []string{"1.2.3.4"}); err != nil {
+		t.Fatal(err)
+	}
+	iw.flush(true)
+
+	want := "ip\tufi\tconfidence\tsource\tlabel\tregion_name\n1.2.3.4\t7\t0.5\tsurvey\toffice\t\n"
+	if out.String() != want {
+		t.Errorf("output %q, want %q", out.String(), want)
+	}
+}
@@ -16,7 +16,6 @@ import (
 	"path"
 	"strconv"
 	"strings"
-	"sync"
 	"syscall"
 	"time"
 
@@ -25,18 +24,21 @@ import (
 	"github.com/facebookgo/grace/gracehttp"
 	olc "github.com/google/open-location-code/go"
 	geoip2 "github.com/oschwald/geoip2-golang"
-	maxminddb "github.com/oschwald/maxminddb-golang"
 	"github.com/peterbourgon/g2g"
 	"github.com/pierrre/geohash"
 )
 
 // Metrics tracks metrics for this server
 var Metrics = struct {
-	Requests *expvar.Int
-	Errors   *expvar.Int
+	Requests     *expvar.Int
+	Errors       *expvar.Int
+	Reloads      *expvar.Int
+	ReloadErrors *expvar.Int
 }{
-	Requests: expvar.NewInt("requests"),
-	Errors:   expvar.NewInt("errors"),
+	Requests:     expvar.NewInt("requests"),
+	Errors:       expvar.NewInt("errors"),
+	Reloads:      expvar.NewInt("reloads"),
+	ReloadErrors: expvar.NewInt("reload_errors"),
 }
 
 var BuildVersion = "(development version)"
@@ -61,27 +63,34 @@ type IPInfo struct {
 	ISP      string `json:"isp"`
 	NetSpeed string `json:"netspeed"`
 	UFI      struct {
-		GuessedUFI int32 `json:"guessed_ufi"`
+		GuessedUFI int32   `json:"guessed_ufi"`
+		Confidence float32 `json:"confidence,omitempty"`
+		Source     string  `json:"source,omitempty"`
+		Label      string  `json:"label,omitempty"`
 	} `json:"ufi"`
 	IPStatus string `json:"ip_status,omitempty"`
 	GeoHash  string `json:"geohash,omitempty"`
 	OLC      string `json:"olc,omitempty"`
 }
 
-// these are connections to the different maxmind geoip databases
-var (
-	gcity  *geodb
-	gspeed *geodb
-	gisp   *geodb
-)
+// setUFI fills in the UFI fields from a range's record
+func (ipinfo *IPInfo) setUFI(v rangeValue) {
+	ipinfo.UFI.GuessedUFI = v.UFI
+	ipinfo.UFI.Confidence = v.Confidence
+	ipinfo.UFI.Source = v.Source
+	ipinfo.UFI.Label = v.Label
+}
 
+// geodb is a connection to one of the maxmind geoip databases.  It's never
+// modified once opened; reloading opens a new one as part of a new generation.
 type geodb struct {
 	db *geoip.Database
-	sync.RWMutex
 }
 
-func (g *geodb) load(dataDir, file string) error {
+func openGeoDB(dataDir, file string) (*geodb, error) {
 	fname := path.Join(dataDir, file)
+	// libGeoIP's own reloading is left off: it would swap files under us
+	// without regard to generations, and the watcher covers every backend
 	var opts = geoip.Options{
 		Caching:        geoip.CacheAll,
 		ReloadOnUpdate: false,
@@ -90,19 +99,14 @@ func (g *geodb) load(dataDir, file string) error {
 	db, err := geoip.Open(fname, &opts)
 	if err != nil {
 		mlog.Printf("error loading %s/%s: %s", dataDir, file, err)
-		return err
+		return nil, err
 	}
 
-	g.Lock()
-	g.db = db
-	g.Unlock()
-	return nil
+	return &geodb{db: db}, nil
 }
 
 func (g *geodb) GetNetSpeed(ip string) string {
-	g.RLock()
 	speed, _ /* netmask */ := g.db.GetName(ip)
-	g.RUnlock()
 	if speed == "" {
 		return "Unknown"
 	}
@@ -111,9 +115,7 @@ func (g *geodb) GetNetSpeed(ip string) string {
 }
 
 func (g *geodb) GetNetSpeedV6(ip string) string {
-	g.RLock()
 	speed, _ /* netmask */ := g.db.GetNameV6(ip)
-	g.RUnlock()
 	if speed == "" {
 		return "Unknown"
 	}
@@ -122,37 +124,34 @@ func (g *geodb) GetNetSpeedV6(ip string) string {
 }
 
 func (g *geodb) GetName(ip string) string {
-	g.RLock()
 	name, _ := g.db.GetName(ip)
-	g.RUnlock()
 	return name
 }
 
 func (g *geodb) GetNameV6(ip string) string {
-	g.RLock()
 	name, _ := g.db.GetNameV6(ip)
-	g.RUnlock()
 	return name
 }
 
 func (g *geodb) GetRecord(ip string) *geoip.Record {
-	g.RLock()
-	r := g.db.Lookup(ip)
-	g.RUnlock()
-	return r
+	return g.db.Lookup(ip)
 }
 
-var (
-	g2city *geoip2.Reader
-	g2ufi  *maxminddb.Reader
-)
-
-// ufis maps IP addresses to UFIs
-var ufis *ipRanges
+// Close releases the database
+func (g *geodb) Close() error {
+	return g.db.Close()
+}
 
 var errParseError = errors.New("ipinfo: parse error")
 
-func lookupIPInfo(ip string) (IPInfo, error) {
+// lookupIPInfo looks up ip in the databases of gen
+func (gen *generation) lookupIPInfo(ip string) (IPInfo, error) {
+	return gen.lookupIPInfoFields(ip, allFields)
+}
+
+// lookupIPInfoFields looks up ip in the databases of gen, skipping those not
+// needed for the selected fields
+func (gen *generation) lookupIPInfoFields(ip string, fields fieldSet) (IPInfo, error) {
 	var netip net.IP
 	if netip = net.ParseIP(ip); netip == nil {
 		return IPInfo{}, errParseError
@@ -162,59 +161,88 @@ func lookupIPInfo(ip string) (IPInfo, error) {
 		IP: ip,
 	}
 
-	if gspeed != nil {
+	if gen.speed != nil && fields.has(fieldNetSpeed) {
+		t0 := time.Now()
 		if netip.To4() != nil {
-			ipinfo.NetSpeed = gspeed.GetNetSpeed(ip)
+			ipinfo.NetSpeed = gen.speed.GetNetSpeed(ip)
 		} else {
-			ipinfo.NetSpeed = gspeed.GetNetSpeedV6(ip)
+			ipinfo.NetSpeed = gen.speed.GetNetSpeedV6(ip)
 		}
+		timeBackend("netspeed", t0)
+		countLookup("netspeed", ipinfo.NetSpeed != "Unknown")
 	}
 
-	if gisp != nil {
+	if gen.isp != nil && fields.has(fieldISP) {
+		t0 := time.Now()
 		if netip.To4() != nil {
-			ipinfo.ISP = gisp.GetName(ip)
+			ipinfo.ISP = gen.isp.GetName(ip)
 		} else {
-			ipinfo.ISP = gisp.GetNameV6(ip)
+			ipinfo.ISP = gen.isp.GetNameV6(ip)
 		}
+		timeBackend("isp", t0)
+		countLookup("isp", ipinfo.ISP != "")
 		// catch unknown org?
 	}
 
-	var ip32 uint32
-
-	if ip4 := netip.To4(); ip4 != nil {
-		ip32 = uint32(ip4[0])<<24 | uint32(ip4[1])<<16 | uint32(ip4[2])<<8 | uint32(ip4[3])
-	}
-
-	if ufis != nil {
-		ufi, ok := ufis.lookup(ip32)
+	if ufis := gen.ufis; ufis != nil && fields.has(fieldUFI) {
+		t0 := time.Now()
+		var v rangeValue
+		var ok bool
+		if ip4 := netip.To4(); ip4 != nil {
+			ip32 := uint32(ip4[0])<<24 | uint32(ip4[1])<<16 | uint32(ip4[2])<<8 | uint32(ip4[3])
+			v, ok = ufis.lookup(ip32)
+		} else {
+			v, ok = ufis.lookup6(uint128FromIP(netip))
+		}
 		if ok {
-			ipinfo.UFI.GuessedUFI = ufi
+			ipinfo.setUFI(v)
 		}
+		timeBackend("ufi", t0)
+		countLookup("ufi", ok)
 	}
 
-	if g2ufi != nil {
-		ufi, err := mmdbIP2UFI(netip)
+	if gen.g2ufi != nil && fields.has(fieldUFI) {
+		t0 := time.Now()
+		v, ok, err := gen.mmdbIP2UFI(netip)
+		timeBackend("ufi_mmdb", t0)
 		if err != nil {
+			countError("lookup", "db_error")
 			mlog.Println("mmdb error: ", err)
 		}
-		ipinfo.UFI.GuessedUFI = ufi
+		ipinfo.setUFI(v)
+		countLookup("ufi_mmdb", ok)
 	}
 
-	if record := gcity.GetRecord(ip); record != nil && record.CountryCode != "" {
+	var record *geoip.Record
+	if gen.city != nil && fields.has(cityFields|fieldGeoHash|fieldOLC) {
+		t0 := time.Now()
+		record = gen.city.GetRecord(ip)
+		timeBackend("city", t0)
+		countLookup("city", record != nil && record.CountryCode != "")
+	}
+	if record != nil && record.CountryCode != "" {
 		ipinfo.City = new(City)
 		ipinfo.City.City = record.City
 		ipinfo.CountryCode = strings.ToLower(record.CountryCode)
 		ipinfo.Latitude = float32(record.Latitude)
 		ipinfo.Longitude = float32(record.Longitude)
 		ipinfo.Region = record.Region
-		ipinfo.RegionName = geoip.GetRegionName(record.CountryCode, record.Region)
-		ipinfo.City.TimeZone = geoip.GetTimeZone(record.CountryCode, record.Region)
+		if fields.has(fieldRegionName) {
+			ipinfo.RegionName = geoip.GetRegionName(record.CountryCode, record.Region)
+		}
+		if fields.has(fieldTimeZone) {
+			ipinfo.City.TimeZone = geoip.GetTimeZone(record.CountryCode, record.Region)
+		}
 		ipinfo.City.PostalCode = record.PostalCode
 		ipinfo.AreaCode = record.AreaCode
-	}
 
-	ipinfo.GeoHash = geohash.Encode(float64(ipinfo.Latitude), float64(ipinfo.Longitude), 10)
-	ipinfo.OLC = olc.Encode(float64(ipinfo.Latitude), float64(ipinfo.Longitude), 10)
+		if fields.has(fieldGeoHash) {
+			ipinfo.GeoHash = geohash.Encode(float64(ipinfo.Latitude), float64(ipinfo.Longitude), 10)
+		}
+		if fields.has(fieldOLC) {
+			ipinfo.OLC = olc.Encode(float64(ipinfo.Latitude), float64(ipinfo.Longitude), 10)
+		}
+	}
 
 	// TODO(dgryski): check EvilISP
 
@@ -233,24 +261,41 @@ func lookupHandler(w http.ResponseWriter, r *http.Request) {
 	args = args[2:]
 
 	if len(args) != 1 {
-		Metrics.Errors.Add(1)
+		countError("lookup", "bad_path")
 		mlog.Println("error parsing request path:", r.URL)
 		http.Error(w, "", http.StatusBadRequest)
 		return
 	}
 
+	fields, err := requestFields(r)
+	if err != nil {
+		countError("lookup", "bad_fields")
+		mlog.Println("error parsing fields:", r.URL, ":", err)
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	gen := acquireGeneration()
+	defer gen.release()
+
 	ip := args[0]
-	ipinfo, err := lookupIPInfo(ip)
+	if ip == "" || ip == "me" {
+		ip = clientIP(r, trustedProxies)
+		// the response depends on who's asking
+		w.Header().Set("Cache-Control", "private")
+	}
+	ipinfo, err := gen.lookupIPInfoFields(ip, fields)
 	if err != nil {
-		Metrics.Errors.Add(1)
+		countError("lookup", "parse_error")
 		mlog.Println("error during lookup:", ip, ":", err)
 		http.Error(w, "", http.StatusBadRequest)
 		return
 	}
 
+	gen.setHeader(w)
 	w.Header().Set("Content-Type", contentTypeJSON)
 	encoder := json.NewEncoder(w)
-	encoder.Encode(ipinfo)
+	encoder.Encode(ipinfo.selectFields(fields))
 }
 
 func lookupsHandler(w http.ResponseWriter, r *http.Request) {
@@ -263,52 +308,117 @@ func lookupsHandler(w http.ResponseWriter, r *http.Request) {
 	args = args[2:]
 
 	if len(args) != 1 {
-		Metrics.Errors.Add(1)
+		countError("lookups", "bad_path")
 		mlog.Println("error parsing request path:", r.URL)
 		http.Error(w, "", http.StatusBadRequest)
 		return
 	}
 
-	ipinfos := make(map[string]IPInfo)
+	fields, err := requestFields(r)
+	if err != nil {
+		countError("lookups", "bad_fields")
+		mlog.Println("error parsing fields:", r.URL, ":", err)
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
 
-	for _, ip := range strings.Split(args[0], ",") {
-		ipinfo, err := lookupIPInfo(ip)
+	gen := acquireGeneration()
+	defer gen.release()
+
+	ips := strings.Split(args[0], ",")
+	prom.batchSize.observe(float64(len(ips)), "lookups")
+
+	ipinfos := make(map[string]interface{})
+
+	for _, ip := range ips {
+		ipinfo, err := gen.lookupIPInfoFields(ip, fields)
 		if err != nil {
-			Metrics.Errors.Add(1)
+			countError("lookups", "parse_error")
 			mlog.Println("error during lookup:", ip, ":", err)
-			ipinfos[ip] = IPInfo{IPStatus: "ParseError"}
-		} else {
-			ipinfos[ip] = ipinfo
+			ipinfo = IPInfo{IPStatus: "ParseError"}
 		}
+		ipinfos[ip] = ipinfo.selectFields(fields)
 	}
 
+	gen.setHeader(w)
 	w.Header().Set("Content-Type", contentTypeJSON)
 	encoder := json.NewEncoder(w)
 	encoder.Encode(ipinfos)
 }
 
+func ufiHandler(w http.ResponseWriter, r *http.Request) {
+
+	Metrics.Requests.Add(1)
+
+	// split path for UFI
+	args := strings.Split(r.URL.Path, "/")
+	// strip entry for "/ufi/"
+	args = args[2:]
+
+	if len(args) != 1 {
+		countError("ufi", "bad_path")
+		mlog.Println("error parsing request path:", r.URL)
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	ufi, err := strconv.ParseInt(args[0], 10, 32)
+	if err != nil {
+		countError("ufi", "parse_error")
+		mlog.Println("error parsing ufi:", args[0], ":", err)
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	gen := acquireGeneration()
+	defer gen.release()
+
+	if gen.ufis == nil {
+		prom.errors.inc("ufi", "db_miss")
+		http.Error(w, "", http.StatusNotFound)
+		return
+	}
+
+	ranges := gen.ufis.reverse(int32(ufi))
+	if ranges == nil {
+		prom.errors.inc("ufi", "db_miss")
+		http.Error(w, "", http.StatusNotFound)
+		return
+	}
+
+	gen.setHeader(w)
+	w.Header().Set("Content-Type", contentTypeJSON)
+	encoder := json.NewEncoder(w)
+	encoder.Encode(newUFIRanges(int32(ufi), ranges))
+}
+
 var errParseIP = errors.New("bad ip: parse error")
 
-func lookupIPInfo2(ip string) (*geoip2.City, error) {
+func (gen *generation) lookupIPInfo2(ip string) (*geoip2.City, error) {
 	netip := net.ParseIP(ip)
 	if netip == nil {
 		return nil, errParseIP
 	}
 
-	return g2city.City(netip)
+	t0 := time.Now()
+	city, err := gen.g2city.City(netip)
+	timeBackend("geoip2", t0)
+	if err == nil {
+		countLookup("geoip2", city.Country.IsoCode != "")
+	}
+	return city, err
 }
 
-func mmdbIP2UFI(netip net.IP) (int32, error) {
-	var onlyUFI struct {
-		UFI int32 `maxminddb:"ufi"`
-	}
+// mmdbIP2UFI returns the record for netip in the UFI mmdb, and whether one was found
+func (gen *generation) mmdbIP2UFI(netip net.IP) (rangeValue, bool, error) {
+	var rec mmdbRecord
 
-	err := g2ufi.Lookup(netip, &onlyUFI)
-	if err != nil {
-		return 0, err
+	err := gen.g2ufi.Lookup(netip, &rec)
+	if err != nil || rec.UFI == nil {
+		return rangeValue{}, false, err
 	}
 
-	return onlyUFI.UFI, nil
+	return rec.value(), true, nil
 }
 
 func lookup2Handler(w http.ResponseWriter, r *http.Request) {
@@ -321,19 +431,29 @@ func lookup2Handler(w http.ResponseWriter, r *http.Request) {
 	args = args[2:]
 
 	if len(args) != 1 {
-		Metrics.Errors.Add(1)
+		countError("lookup2", "bad_path")
 		http.Error(w, "", http.StatusBadRequest)
 		return
 	}
 
+	gen := acquireGeneration()
+	defer gen.release()
+
+	if gen.g2city == nil {
+		prom.errors.inc("lookup2", "db_miss")
+		http.Error(w, "", http.StatusNotFound)
+		return
+	}
+
 	ip := args[0]
-	ipinfo, err := lookupIPInfo2(ip)
+	ipinfo, err := gen.lookupIPInfo2(ip)
 	if err != nil {
-		Metrics.Errors.Add(1)
+		countError("lookup2", "parse_error")
 		http.Error(w, "", http.StatusBadRequest)
 		return
 	}
 
+	gen.setHeader(w)
 	w.Header().Set("Content-Type", contentTypeJSON)
 	encoder := json.NewEncoder(w)
 	encoder.Encode(ipinfo)
@@ -354,72 +474,60 @@ func lookups2Handler(w http.ResponseWriter, r *http.Request) {
 	args = args[2:]
 
 	if len(args) != 1 {
-		Metrics.Errors.Add(1)
+		countError("lookups2", "bad_path")
 		http.Error(w, "", http.StatusBadRequest)
 		return
 	}
 
+	gen := acquireGeneration()
+	defer gen.release()
+
+	if gen.g2city == nil {
+		prom.errors.inc("lookups2", "db_miss")
+		http.Error(w, "", http.StatusNotFound)
+		return
+	}
+
+	ips := strings.Split(args[0], ",")
+	prom.batchSize.observe(float64(len(ips)), "lookups2")
+
 	ipinfos := make(map[string]IP2Info)
 
-	for _, ip := range strings.Split(args[0], ",") {
-		ipinfo, err := lookupIPInfo2(ip)
+	for _, ip := range ips {
+		ipinfo, err := gen.lookupIPInfo2(ip)
 		if err != nil {
-			Metrics.Errors.Add(1)
+			countError("lookups2", "parse_error")
 			ipinfos[ip] = IP2Info{IPStatus: "ParseError"}
 		} else {
 			ipinfos[ip] = IP2Info{City: ipinfo}
 		}
 	}
 
+	gen.setHeader(w)
 	w.Header().Set("Content-Type", contentTypeJSON)
 	encoder := json.NewEncoder(w)
 	encoder.Encode(ipinfos)
 }
 
-func loadDataFiles(lite bool, datadir, ufi string, isbinary bool) error {
-
-	var err error
-
-	if lite {
-		e := gcity.load(datadir, "GeoLiteCity.dat")
-		if e != nil {
-			err = e
-		}
-	} else {
-		e := gcity.load(datadir, "GeoIPCity.dat") // This IP is in "Amsterdam"
-		if e != nil {
-			err = e
-		}
-		e = gspeed.load(datadir, "GeoIPNetSpeed.dat") // This IP belongs to Vodafone and it's a mobile thing, or it's Comcast / DSL..
-		if e != nil {
-			err = e
-		}
-
-		e = gisp.load(datadir, "GeoIPISP.dat") // This is "Time Warner" or "AOL"
-		if e != nil {
-			err = e
-		}
+func saveBinary(fname string, ranges rangeSet, source string) {
+	fname = fmt.Sprintf("%s.bin", fname)
+	log.Println("writing", len(ranges.v4), "IPv4 and", len(ranges.v6), "IPv6 items to", fname)
+	file, err := os.Create(fname)
+	if err != nil {
+		log.Println("can't open file: ", fname, err)
+		return
 	}
 
-	if ufi != "" {
-		// ip -> ufi mapping
-		ranges, e := loadIPRanges(ufi, isbinary)
-		if e != nil {
-			mlog.Printf("unable to load %s: %s", ufi, e)
-			err = e
-		} else {
-			ufis.Lock()
-			ufis.ranges = ranges
-			ufis.Unlock()
-		}
+	defer file.Close()
+	err = writeBinary(file, ranges, binaryInfo{Created: time.Now(), Source: source})
+	if err != nil {
+		log.Fatal("saveBinary failed", err)
 	}
-
-	return err
 }
 
-func saveBinary(fname string, ranges []ipRange) {
-	fname = fmt.Sprintf("%s.bin", fname)
-	log.Println("writing", len(ranges), "items to", fname)
+func saveMMDB(fname string, ranges rangeSet, opts mmdbOptions) {
+	fname = fmt.Sprintf("%s.mmdb", fname)
+	log.Println("writing", len(ranges.v4), "IPv4 and", len(ranges.v6), "IPv6 items to", fname)
 	file, err := os.Create(fname)
 	if err != nil {
 		log.Println("can't open file: ", fname, err)
@@ -427,9 +535,9 @@ func saveBinary(fname string, ranges []ipRange) {
 	}
 
 	defer file.Close()
-	err = writeBinary(file, ranges)
+	err = writeMMDB(file, ranges, opts)
 	if err != nil {
-		log.Fatal("saveBinary failed", err)
+		log.Fatal("saveMMDB failed", err)
 	}
 }
 
@@ -440,74 +548,174 @@ func main() {
 	ufi := flag.String("ufi", "", "File containing iprange-to-UFI mappings")
 	ufi2 := flag.String("ufi2", "", "File containing iprange-to-UFI mappings mmdb")
 	isbinary := flag.Bool("isbinary", false, "load iprange-to-UFI mapping as a binary file instead of parsing it as CSV")
+	usemmap := flag.Bool("mmap", false, "memory-map the binary iprange-to-UFI file instead of loading it into memory (implies -isbinary)")
+	shard := flag.Bool("shard", false, "index the iprange-to-UFI mapping by first octet for faster IPv4 lookups")
 	convert := flag.Bool("convert", false, "Parse iprange-to-UFI CSV and save it as Memory-map files")
+	format := flag.String("format", "bin", "Output format for -convert: bin or mmdb")
+	recordSize := flag.Int("recordsize", 32, "Search tree record size in bits for -format=mmdb: 24, 28 or 32")
+	merge := flag.Bool("merge", false, "Coalesce adjacent ranges with the same UFI when converting")
+	source := flag.String("source", "", "Source description to record in converted binary files (default: the input file name)")
+	columns := flag.String("columns", "", "Comma-separated layout of the iprange-to-UFI CSV, e.g. from,to,ufi,confidence,source,label (default: inferred from each row)")
+	validate := flag.Bool("validate", false, "Check the iprange-to-UFI file for errors and report coverage statistics")
 	lite := flag.Bool("lite", false, "Load only GeoLiteCity.dat")
+	canaryList := flag.String("canaries", "", "Comma-separated ip=country pairs which /readyz checks are found in the expected country")
+	proxies := flag.String("trustedproxies", "", "Comma-separated CIDRs of proxies whose Forwarded, X-Forwarded-For and X-Real-IP headers are believed by /lookup/me")
+	watch := flag.Duration("watch", 0, "Poll the data files at this interval and reload them when they change (0 disables)")
+	flag.IntVar(&maxBatch, "maxbatch", maxBatch, "Most addresses accepted in a POST to /lookups")
 	port := flag.Int("p", 8080, "port")
 
 	flag.Parse()
 
-	if *data2Dir != "" {
-		var err error
-		g2city, err = geoip2.Open(*data2Dir + "/GeoLite2-City.mmdb")
-		if err != nil {
-			mlog.Fatal("error loading geoip2:", err)
+	// the subcommands load CSV files too, so need the layout
+	if *columns != "" {
+		csvColumns = strings.Split(*columns, ",")
+		if err := checkColumns(csvColumns); err != nil {
+			mlog.Fatal("bad -columns: ", err)
 		}
 	}
 
-	if *ufi2 != "" {
-		var err error
-		g2ufi, err = maxminddb.Open(*ufi2)
-		if err != nil {
-			mlog.Fatal("error loading ip2ufi:", err)
-		}
+	switch flag.Arg(0) {
+	case "diff":
+		os.Exit(diffMain(flag.Args()[1:]))
+	case "export":
+		os.Exit(exportMain(flag.Args()[1:]))
 	}
 
 	if *ufi != "" {
-		ufis = new(ipRanges)
+		if *validate {
+			ranges, err := loadIPRanges(*ufi, *isbinary)
+			if err != nil {
+				mlog.Fatal("unable to load ", *ufi, ": ", err)
+			}
+			report := validateRanges(ranges)
+			report.write(os.Stdout)
+			if report.errors() > 0 {
+				os.Exit(1)
+			}
+			return
+		}
 		if *convert {
 			mlog.Println("loading iprange-to-UFI CSV")
 			ranges, e := loadIPRanges(*ufi, *isbinary)
 			if e == nil {
-				saveBinary(*ufi, ranges)
+				if *source == "" {
+					*source = *ufi
+				}
+				if *merge {
+					merged := ranges.compact()
+					mlog.Printf("merged %d IPv4 ranges into %d, %d IPv6 ranges into %d", len(ranges.v4), len(merged.v4), len(ranges.v6), len(merged.v6))
+					ranges = merged
+				}
+				switch *format {
+				case "bin":
+					saveBinary(*ufi, ranges, *source)
+				case "mmdb":
+					saveMMDB(*ufi, ranges, mmdbOptions{
+						RecordSize:   *recordSize,
+						DatabaseType: "IP2UFI",
+						Description:  "IP to UFI mapping from " + *source,
+						BuildEpoch:   time.Now(),
+					})
+				default:
+					mlog.Fatal("unknown output format: ", *format)
+				}
 			}
 			return
 		}
 	}
 
+	if *usemmap && *shard {
+		mlog.Fatal("-mmap and -shard can't be used together")
+	}
+
+	config := dataConfig{
+		Lite:     *lite,
+		DataDir:  *dataDir,
+		Data2Dir: *data2Dir,
+		UFI:      *ufi,
+		UFI2:     *ufi2,
+		IsBinary: *isbinary,
+		Mmap:     *usemmap,
+		Shard:    *shard,
+	}
+
+	switch flag.Arg(0) {
+	case "lookup":
+		os.Exit(lookupMain(config, flag.Args()[1:]))
+	case "enrich":
+		os.Exit(enrichMain(config, flag.Args()[1:]))
+	}
+
+	if *proxies != "" {
+		var err error
+		trustedProxies, err = parseTrustedProxies(*proxies)
+		if err != nil {
+			mlog.Fatal("bad -trustedproxies: ", err)
+		}
+	}
+
+	var canaries []canary
+	if *canaryList != "" {
+		var err error
+		canaries, err = parseCanaries(*canaryList)
+		if err != nil {
+			mlog.Fatal("bad -canaries: ", err)
+		}
+	}
+
 	expvar.NewString("BuildVersion").Set(BuildVersion)
+	expvar.Publish("ufi_shards", expvar.Func(func() interface{} {
+		gen := acquireGeneration()
+		defer gen.release()
+		if gen.ufis == nil {
+			return nil
+		}
+		return gen.ufis.shardStats()
+	}))
+	expvar.Publish("latency", expvar.Func(latencyVar))
+	go rotateLatencyWindows()
+	expvar.Publish("generation", expvar.Func(func() interface{} {
+		gen := acquireGeneration()
+		defer gen.release()
+		return gen.info()
+	}))
 
 	// TODO(dgryski): add proper log output
 	mlog.Println("rgip starting", BuildVersion)
 
-	gcity = new(geodb)
-	if !*lite {
-		gspeed = new(geodb)
-		gisp = new(geodb)
-	}
-
-	err := loadDataFiles(*lite, *dataDir, *ufi, *isbinary)
+	_, err := loadDataFiles(config)
 	if err != nil {
 		mlog.Fatal("error loading data files: ", err)
 	}
 
-	// start the reload-on-change handler
+	reload := func(why string) {
+		mlog.Println("Attempting to reload data files:", why)
+		// TODO(dgryski): run this in a goroutine and catch panics()?
+		_, err := loadDataFiles(config)
+		if err != nil {
+			// don't log err here, we've already done it in loadDataFiles
+			mlog.Println("failed to load some data files, still serving the previous generation")
+		} else {
+			mlog.Println("All data files reloaded successfully")
+		}
+	}
+
+	// start the reload-on-signal handler
 	go func() {
 		sigs := make(chan os.Signal, 1)
 		signal.Notify(sigs, syscall.SIGHUP)
 
 		for range sigs {
-			mlog.Println("Attempting to reload data files")
-			// TODO(dgryski): run this in a goroutine and catch panics()?
-			err := loadDataFiles(*lite, *dataDir, *ufi, *isbinary)
-			if err != nil {
-				// don't log err here, we've already done it in loadDataFiles
-				mlog.Println("failed to load some data files")
-			} else {
-				mlog.Println("All data files reloaded successfully")
-			}
+			reload("SIGHUP")
 		}
 	}()
 
+	// and the reload-on-change handler
+	if *watch > 0 {
+		w := newWatcher(config.files())
+		go w.run(*watch, func() { reload("data files changed") })
+	}
+
 	if host := os.Getenv("GRAPHITEHOST") + ":" + os.Getenv("GRAPHITEPORT"); host != ":" {
 		// register our metrics with graphite
 		graphite := g2g.NewGraphite(host, 60*time.Second, 10*time.Second)
@@ -517,13 +725,33 @@ func main() {
 
 		graphite.Register(fmt.Sprintf("http.rgip.%s.requests", hostname), Metrics.Requests)
 		graphite.Register(fmt.Sprintf("http.rgip.%s.errors", hostname), Metrics.Errors)
+		graphite.Register(fmt.Sprintf("http.rgip.%s.reloads", hostname), Metrics.Reloads)
+		graphite.Register(fmt.Sprintf("http.rgip.%s.reload_errors", hostname), Metrics.ReloadErrors)
+		registerLatency(graphite, fmt.Sprintf("http.rgip.%s.latency", hostname))
 	}
 
-	http.HandleFunc("/lookup/", lookupHandler)
-	http.HandleFunc("/lookups/", lookupsHandler)
+	http.HandleFunc("/lookup/", instrument("lookup", lookupHandler))
+	http.HandleFunc("/lookups/", instrument("lookups", lookupsHandler))
+	http.HandleFunc("/lookups", instrument("lookups_post", lookupsPostHandler))
+	http.HandleFunc("/stream", instrument("stream", streamHandler))
+
+	http.HandleFunc("/ufi/", instrument("ufi", ufiHandler))
 
-	http.HandleFunc("/lookup2/", lookup2Handler)
-	http.HandleFunc("/lookups2/", lookups2Handler)
+	http.HandleFunc("/lookup2/", instrument("lookup2", lookup2Handler))
+	http.HandleFunc("/lookups2/", instrument("lookups2", lookups2Handler))
+
+	http.HandleFunc("/metrics", instrument("metrics", metricsHandler))
+
+	// probes aren't counted in Metrics.Requests (the "requests" expvar),
+	// only in rgip_requests_total
+	http.HandleFunc("/healthz", instrument("healthz", healthzHandler))
+	http.HandleFunc("/readyz", instrument("readyz", readyzHandler(canaries)))
+
+	// the admin API is only available with a token to authenticate it
+	if token := os.Getenv("ADMINTOKEN"); token != "" {
+		http.HandleFunc("/admin/reload", instrument("admin_reload", adminAuth(token, adminReloadHandler(config))))
+		http.HandleFunc("/admin/data", instrument("admin_data", adminAuth(token, adminDataHandler)))
+	}
 
 	if p := os.Getenv("PORT"); p != "" {
 		*port, err = strconv.Atoi(p)
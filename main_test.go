@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+// testGeneration returns a generation mapping 1.2.3.0/24 to UFI 7
+func testGeneration() *generation {
+	gen := &generation{ufis: new(ipRanges)}
+	gen.ufis.swap(rangeSet{v4: ipRangeList{{0x01020300, 0x010203ff, 7}}})
+	return gen
+}
+
+func TestLookupWithoutCity(t *testing.T) {
+	gen := testGeneration()
+
+	// an address with no city record has no location to encode
+	ipinfo, err := gen.lookupIPInfo("1.2.3.4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ipinfo.City != nil || ipinfo.GeoHash != "" || ipinfo.OLC != "" {
+		t.Errorf("lookupIPInfo=%+v, want no city, geohash or OLC", ipinfo)
+	}
+	if ipinfo.UFI.GuessedUFI != 7 {
+		t.Errorf("UFI %d, want 7", ipinfo.UFI.GuessedUFI)
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the latency histograms
+var latencyBuckets = []float64{.00001, .000025, .00005, .0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1}
+
+// batchBuckets are the upper bounds of the batch size histograms
+var batchBuckets = []float64{1, 2, 5, 10, 25, 50, 100, 250, 500, 1000}
+
+// labelValues joins the values of a metric's labels into a map key
+func labelValues(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels formats a key made by labelValues as name="value" pairs
+func formatLabels(names []string, key string, extra ...string) string {
+	var pairs []string
+	if len(names) > 0 {
+		for i, v := range strings.Split(key, "\xff") {
+			pairs = append(pairs, fmt.Sprintf(`%s="%s"`, names[i], labelEscaper.Replace(v)))
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extra[i], extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return fmt.Sprint(v)
+}
+
+// counterVec is a set of counters distinguished by label values
+type counterVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string]uint64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: make(map[string]uint64)}
+}
+
+// inc increments the counter with the given label values
+func (c *counterVec) inc(values ...string) {
+	key := labelValues(values)
+	c.mu.Lock()
+	c.values[key]++
+	c.mu.Unlock()
+}
+
+func (c *counterVec) get(values ...string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[labelValues(values)]
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %d\n", c.name, formatLabels(c.labels, key), c.values[key])
+	}
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// histogram counts observations into buckets
+type histogram struct {
+	buckets []float64 // buckets are the upper bounds of each bucket, in increasing order
+	counts  []uint64  // counts has a count for each bucket, then one for larger values
+	count   uint64
+	sum     float64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets)+1)}
+}
+
+func (h *histogram) observe(v float64) {
+	h.counts[sort.SearchFloat64s(h.buckets, v)]++
+	h.count++
+	h.sum += v
+}
+
+func (h *histogram) copy() *histogram {
+	c := *h
+	c.counts = append([]uint64(nil), h.counts...)
+	return &c
+}
+
+// sub returns the observations in h that aren't in the earlier snapshot o
+func (h *histogram) sub(o *histogram) *histogram {
+	d := h.copy()
+	if o == nil {
+		return d
+	}
+	for i := range d.counts {
+		d.counts[i] -= o.counts[i]
+	}
+	d.count -= o.count
+	d.sum -= o.sum
+	return d
+}
+
+// quantile estimates the q'th quantile by interpolating within its bucket.
+// Values beyond the largest bucket are reported as its upper bound.
+func (h *histogram) quantile(q float64) float64 {
+	if h.count == 0 {
+		return 0
+	}
+
+	rank := q * float64(h.count)
+	var cumulative uint64
+	for i, n := range h.counts {
+		if n == 0 || float64(cumulative+n) < rank {
+			cumulative += n
+			continue
+		}
+		if i == len(h.buckets) {
+			break
+		}
+		lower := 0.0
+		if i > 0 {
+			lower = h.buckets[i-1]
+		}
+		return lower + (h.buckets[i]-lower)*(rank-float64(cumulative))/float64(n)
+	}
+	return h.buckets[len(h.buckets)-1]
+}
+
+// histogramVec is a set of histograms distinguished by label values
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	values map[string]*histogram
+
+	// prev is the snapshot taken at the last rotate, and window is
+	// the observations between the two rotates before that
+	prev   map[string]*histogram
+	window map[string]*histogram
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, values: make(map[string]*histogram)}
+}
+
+// rotate starts a new window
+func (h *histogramVec) rotate() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	prev := make(map[string]*histogram, len(h.values))
+	window := make(map[string]*histogram, len(h.values))
+	for key, hist := range h.values {
+		window[key] = hist.sub(h.prev[key])
+		prev[key] = hist.copy()
+	}
+	h.prev, h.window = prev, window
+}
+
+// get returns a copy of the histogram with the given label values, and of
+// its last complete window
+func (h *histogramVec) get(values ...string) (total, window *histogram) {
+	key := labelValues(values)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	total, window = newHistogram(h.buckets), newHistogram(h.buckets)
+	if hist, ok := h.values[key]; ok {
+		total = hist.copy()
+	}
+	if hist, ok := h.window[key]; ok {
+		window = hist.copy()
+	}
+	return total, window
+}
+
+// observe adds v to the histogram with the given label values
+func (h *histogramVec) observe(v float64, values ...string) {
+	key := labelValues(values)
+	h.mu.Lock()
+	hist, ok := h.values[key]
+	if !ok {
+		hist = newHistogram(h.buckets)
+		h.values[key] = hist
+	}
+	hist.observe(v)
+	h.mu.Unlock()
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	keys := make([]string, 0, len(h.values))
+	for k := range h.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, key := range keys {
+		hist := h.values[key]
+		var cumulative uint64
+		for i, n := range hist.counts {
+			cumulative += n
+			le := math.Inf(1)
+			if i < len(hist.buckets) {
+				le = hist.buckets[i]
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "le", formatFloat(le)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_sum%s %v\n", h.name, formatLabels(h.labels, key), hist.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, key), hist.count)
+	}
+}
+
+// prom holds the metrics exported in Prometheus format by /metrics
+var prom = struct {
+	requests  *counterVec
+	errors    *counterVec
+	latency   *histogramVec
+	batchSize *histogramVec
+	lookups   *counterVec
+	backends  *histogramVec
+}{
+	requests:  newCounterVec("rgip_requests_total", "Requests by handler.", "handler"),
+	errors:    newCounterVec("rgip_errors_total", "Failed requests and lookups by handler and reason.", "handler", "reason"),
+	latency:   newHistogramVec("rgip_request_duration_seconds", "Time taken to serve requests by handler.", latencyBuckets, "handler"),
+	batchSize: newHistogramVec("rgip_batch_size", "Number of addresses in batch requests by handler.", batchBuckets, "handler"),
+	lookups:   newCounterVec("rgip_db_lookups_total", "Lookups by database and whether the address was found.", "db", "result"),
+	backends:  newHistogramVec("rgip_db_lookup_duration_seconds", "Time taken to look up an address by database.", latencyBuckets, "db"),
+}
+
+// countError records a failed request or lookup
+func countError(handler, reason string) {
+	Metrics.Errors.Add(1)
+	prom.errors.inc(handler, reason)
+}
+
+// countLookup records whether an address was found in a database
+func countLookup(db string, hit bool) {
+	if hit {
+		prom.lookups.inc(db, "hit")
+	} else {
+		prom.lookups.inc(db, "miss")
+	}
+}
+
+// instrument wraps a handler, counting and timing its requests
+func instrument(handler string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t0 := time.Now()
+		h(w, r)
+		prom.requests.inc(handler)
+		prom.latency.observe(time.Since(t0).Seconds(), handler)
+	}
+}
+
+// writeGauge writes a single unlabelled metric
+func writeGauge(w io.Writer, name, typ, help string, v float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %s\n", name, help, name, typ, name, formatFloat(v))
+}
+
+// metricsHandler serves the metrics in the Prometheus text format
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	prom.requests.write(w)
+	prom.errors.write(w)
+	prom.latency.write(w)
+	prom.batchSize.write(w)
+	prom.lookups.write(w)
+	prom.backends.write(w)
+
+	writeGauge(w, "rgip_reloads_total", "counter", "Attempts to load a generation of the data files.", float64(Metrics.Reloads.Value()))
+	writeGauge(w, "rgip_reload_errors_total", "counter", "Failed attempts to load a generation of the data files.", float64(Metrics.ReloadErrors.Value()))
+
+	gen := acquireGeneration()
+	defer gen.release()
+
+	var last float64
+	if gen.id != 0 {
+		last = float64(gen.loaded.UnixNano()) / 1e9
+	}
+	writeGauge(w, "rgip_last_successful_reload_timestamp_seconds", "gauge", "When the current generation of the data files was loaded.", last)
+	writeGauge(w, "rgip_generation", "gauge", "Id of the generation of the data files serving lookups.", float64(gen.id))
+}
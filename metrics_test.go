@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHistogramVecWrite(t *testing.T) {
+	h := newHistogramVec("test_size", "Sizes.", []float64{1, 10}, "handler")
+	for _, v := range []float64{1, 5, 50} {
+		h.observe(v, "lookups")
+	}
+
+	var buf bytes.Buffer
+	h.write(&buf)
+
+	want := `# HELP test_size Sizes.
+# TYPE test_size histogram
+test_size_bucket{handler="lookups",le="1"} 1
+test_size_bucket{handler="lookups",le="10"} 2
+test_size_bucket{handler="lookups",le="+Inf"} 3
+test_size_sum{handler="lookups"} 56
+test_size_count{handler="lookups"} 3
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestCounterVecWrite(t *testing.T) {
+	c := newCounterVec("test_total", "Things.", "db", "result")
+	c.inc("city", "miss")
+	c.inc("city", "hit")
+	c.inc("city", "hit")
+
+	var buf bytes.Buffer
+	c.write(&buf)
+
+	want := `# HELP test_total Things.
+# TYPE test_total counter
+test_total{db="city",result="hit"} 2
+test_total{db="city",result="miss"} 1
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	h := instrument("test", func(w http.ResponseWriter, r *http.Request) {
+		countError("test", "bad_path")
+	})
+	h(httptest.NewRecorder(), httptest.NewRequest("GET", "/test/", nil))
+
+	if n := prom.requests.get("test"); n != 1 {
+		t.Errorf("requests=%d, want 1", n)
+	}
+
+	if total, _ := prom.latency.get("test"); total.count != 1 {
+		t.Errorf("latency count=%d, want 1", total.count)
+	}
+
+	// every instrumented handler has its latency reported
+	handlers := latencyVar().(map[string]interface{})["handlers"].(map[string]latencySummary)
+	for _, name := range []string{"stream", "metrics", "healthz", "readyz", "admin_reload", "admin_data"} {
+		if _, ok := handlers[name]; !ok {
+			t.Errorf("no latency reported for %s", name)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	metricsHandler(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+
+	for _, want := range []string{
+		`rgip_requests_total{handler="test"} 1`,
+		`rgip_errors_total{handler="test",reason="bad_path"} 1`,
+		`rgip_request_duration_seconds_count{handler="test"} 1`,
+		"rgip_reloads_total ",
+		"rgip_last_successful_reload_timestamp_seconds ",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics missing %q", want)
+		}
+	}
+}
+
+func TestHistogramQuantile(t *testing.T) {
+	h := newHistogram([]float64{1, 10})
+	if q := h.quantile(0.5); q != 0 {
+		t.Errorf("empty quantile=%v, want 0", q)
+	}
+
+	for _, v := range []float64{1, 5, 50} {
+		h.observe(v)
+	}
+
+	for _, tt := range []struct {
+		q, want float64
+	}{
+		{0.3, 0.9},
+		{0.5, 5.5},
+		{0.99, 10},
+	} {
+		if got := h.quantile(tt.q); got < tt.want-1e-9 || got > tt.want+1e-9 {
+			t.Errorf("quantile(%v)=%v, want %v", tt.q, got, tt.want)
+		}
+	}
+}
+
+func TestHistogramVecWindow(t *testing.T) {
+	h := newHistogramVec("test_seconds", "Latency.", []float64{0.001, 0.01}, "db")
+
+	h.observe(0.0005, "city")
+	h.rotate()
+	h.observe(0.005, "city")
+	h.observe(0.005, "city")
+	h.rotate()
+	h.observe(0.05, "city")
+
+	total, window := h.get("city")
+	if total.count != 4 {
+		t.Errorf("total count=%d, want 4", total.count)
+	}
+	if window.count != 2 || window.counts[1] != 2 {
+		t.Errorf("window=%+v, want the 2 observations between rotations", window)
+	}
+
+	if st := window.stats(); st.Count != 2 || st.MeanMs < 4.99 || st.MeanMs > 5.01 {
+		t.Errorf("window stats=%+v, want 2 observations with mean 5ms", st)
+	}
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"time"
+
+	maxminddb "github.com/oschwald/maxminddb-golang"
+)
+
+// mmdbMetadataStart separates the data section from the metadata in a MaxMind DB file
+var mmdbMetadataStart = []byte("\xab\xcd\xefMaxMind.com")
+
+// MaxMind DB data section types
+const (
+	mmdbString = 2
+	mmdbUint16 = 5
+	mmdbUint32 = 6
+	mmdbMap    = 7
+	mmdbInt32  = 8
+	mmdbUint64 = 9
+	mmdbArray  = 11
+	mmdbFloat  = 15
+)
+
+// mmdbOptions configure the MaxMind DB files written by writeMMDB
+type mmdbOptions struct {
+	RecordSize   int       // RecordSize is the size of a search tree record in bits: 24, 28 or 32
+	DatabaseType string    // DatabaseType is stored in the database_type metadata field
+	Description  string    // Description is stored as the English description
+	BuildEpoch   time.Time // BuildEpoch is when the database was built
+}
+
+// mmdbNode is a node of the search tree.  Each side is either another node,
+// or a leaf holding a value index, where 0 means no data.
+type mmdbNode struct {
+	child [2]*mmdbNode
+	data  [2]int
+}
+
+// mmdbTree is a binary search tree over the bits of an address
+type mmdbTree struct {
+	root  *mmdbNode
+	width int // width is the number of bits in an address: 32 or 128
+}
+
+// insert sets the value of the prefixLen-bit prefix of ip, replacing anything
+// previously inserted within it
+func (t *mmdbTree) insert(ip uint128, prefixLen int, value int) {
+	if prefixLen == 0 {
+		*t.root = mmdbNode{data: [2]int{value, value}}
+		return
+	}
+
+	n := t.root
+	for depth := 0; depth < prefixLen-1; depth++ {
+		b := ip.bit(t.width - 1 - depth)
+		if n.child[b] == nil {
+			// split the leaf, keeping its value in the rest of the block
+			n.child[b] = &mmdbNode{data: [2]int{n.data[b], n.data[b]}}
+			n.data[b] = 0
+		}
+		n = n.child[b]
+	}
+
+	b := ip.bit(t.width - prefixLen)
+	n.child[b] = nil
+	n.data[b] = value
+}
+
+// node returns the node for the prefixLen-bit prefix of ip, creating it if needed
+func (t *mmdbTree) node(ip uint128, prefixLen int) *mmdbNode {
+	n := t.root
+	for depth := 0; depth < prefixLen; depth++ {
+		b := ip.bit(t.width - 1 - depth)
+		if n.child[b] == nil {
+			n.child[b] = &mmdbNode{data: [2]int{n.data[b], n.data[b]}}
+			n.data[b] = 0
+		}
+		n = n.child[b]
+	}
+	return n
+}
+
+// alias makes the prefixLen-bit prefix of ip share the subtree at target
+func (t *mmdbTree) alias(ip uint128, prefixLen int, target *mmdbNode) {
+	parent := t.node(ip, prefixLen-1)
+	b := ip.bit(t.width - prefixLen)
+	parent.child[b] = target
+	parent.data[b] = 0
+}
+
+// number assigns node numbers in breadth-first order, visiting aliased subtrees once
+func (t *mmdbTree) number() ([]*mmdbNode, map[*mmdbNode]int) {
+	ids := map[*mmdbNode]int{t.root: 0}
+	nodes := []*mmdbNode{t.root}
+	for i := 0; i < len(nodes); i++ {
+		for _, c := range nodes[i].child {
+			if c == nil {
+				continue
+			}
+			if _, ok := ids[c]; !ok {
+				ids[c] = len(nodes)
+				nodes = append(nodes, c)
+			}
+		}
+	}
+	return nodes, ids
+}
+
+// mmdbEncoder writes values in the MaxMind DB data section format
+type mmdbEncoder struct {
+	bytes.Buffer
+}
+
+func (e *mmdbEncoder) control(typ int, size int) {
+	var sizeBytes []byte
+	switch {
+	case size < 29:
+	case size < 29+256:
+		sizeBytes = []byte{byte(size - 29)}
+		size = 29
+	case size < 285+65536:
+		size -= 285
+		sizeBytes = []byte{byte(size >> 8), byte(size)}
+		size = 30
+	default:
+		size -= 65821
+		sizeBytes = []byte{byte(size >> 16), byte(size >> 8), byte(size)}
+		size = 31
+	}
+
+	if typ <= 7 {
+		e.WriteByte(byte(typ<<5 | size))
+	} else {
+		e.WriteByte(byte(size))
+		e.WriteByte(byte(typ - 7))
+	}
+	e.Write(sizeBytes)
+}
+
+func (e *mmdbEncoder) putString(s string) {
+	e.control(mmdbString, len(s))
+	e.WriteString(s)
+}
+
+func (e *mmdbEncoder) putUint(typ int, v uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	n := 0
+	for n < len(b) && b[n] == 0 {
+		n++
+	}
+	e.control(typ, len(b)-n)
+	e.Write(b[n:])
+}
+
+func (e *mmdbEncoder) putInt32(v int32) {
+	if v < 0 {
+		// readers don't sign-extend, so negative values use all four bytes
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], uint32(v))
+		e.control(mmdbInt32, len(b))
+		e.Write(b[:])
+		return
+	}
+	e.putUint(mmdbInt32, uint64(v))
+}
+
+func (e *mmdbEncoder) putFloat(v float32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], math.Float32bits(v))
+	e.control(mmdbFloat, len(b))
+	e.Write(b[:])
+}
+
+// putValue writes the record stored for a range.  Fields other than ufi are
+// left out when they're empty.
+func (e *mmdbEncoder) putValue(v rangeValue) {
+	n := 1
+	for _, set := range []bool{v.Confidence != 0, v.Source != "", v.Label != ""} {
+		if set {
+			n++
+		}
+	}
+
+	e.control(mmdbMap, n)
+	e.putString("ufi")
+	e.putInt32(v.UFI)
+	if v.Confidence != 0 {
+		e.putString("confidence")
+		e.putFloat(v.Confidence)
+	}
+	if v.Source != "" {
+		e.putString("source")
+		e.putString(v.Source)
+	}
+	if v.Label != "" {
+		e.putString("label")
+		e.putString(v.Label)
+	}
+}
+
+// writeMMDB writes ranges as a MaxMind DB file with a record holding the
+// ufi, confidence, source and label of each range.  An IPv4 database is written if there are only IPv4 ranges,
+// otherwise an IPv6 database with the IPv4 ranges in ::/96, also reachable
+// through ::ffff:0:0/96.
+func writeMMDB(file io.Writer, ranges rangeSet, opts mmdbOptions) error {
+	switch opts.RecordSize {
+	case 24, 28, 32:
+	default:
+		return fmt.Errorf("unsupported record size %d", opts.RecordSize)
+	}
+
+	// each distinct value is stored once in the data section
+	var data mmdbEncoder
+	offsets := make(map[rangeValue]int)
+	value := func(d int32) int {
+		v := ranges.table.get(d)
+		off, ok := offsets[v]
+		if !ok {
+			off = data.Len()
+			offsets[v] = off
+			data.putValue(v)
+		}
+		// leaf values are offset by one so 0 can mean empty
+		return off + 1
+	}
+
+	ipVersion := 4
+	t := &mmdbTree{root: new(mmdbNode), width: 32}
+	if len(ranges.v6) > 0 {
+		ipVersion = 6
+		t.width = 128
+	}
+
+	for _, r := range ranges.v6 {
+		v := value(r.data)
+		splitRange(r.rangeFrom, r.rangeTo, 128, func(ip uint128, prefixLen int) {
+			t.insert(ip, prefixLen, v)
+		})
+	}
+
+	// IPv4 addresses live in ::/96 of an IPv6 tree
+	v4prefix := t.width - 32
+	if v4prefix > 0 && len(ranges.v4) > 0 {
+		t.insert(uint128{}, v4prefix, 0)
+	}
+
+	for _, r := range ranges.v4 {
+		v := value(r.data)
+		splitRange(uint128{0, uint64(r.rangeFrom)}, uint128{0, uint64(r.rangeTo)}, 32, func(ip uint128, prefixLen int) {
+			t.insert(ip, v4prefix+prefixLen, v)
+		})
+	}
+
+	if v4prefix > 0 && len(ranges.v4) > 0 {
+		t.alias(uint128{0, 0xffff << 32}, v4prefix, t.node(uint128{}, v4prefix))
+	}
+
+	nodes, ids := t.number()
+	nodeCount := len(nodes)
+
+	maxRecord := uint64(nodeCount) + 16 + uint64(data.Len())
+	if maxRecord >= 1<<uint(opts.RecordSize) {
+		return fmt.Errorf("record size %d too small for %d nodes and %d bytes of data", opts.RecordSize, nodeCount, data.Len())
+	}
+
+	record := func(n *mmdbNode, side int) uint32 {
+		if c := n.child[side]; c != nil {
+			return uint32(ids[c])
+		}
+		if v := n.data[side]; v != 0 {
+			return uint32(nodeCount + 16 + v - 1)
+		}
+		return uint32(nodeCount)
+	}
+
+	w := bufio.NewWriter(file)
+
+	for _, n := range nodes {
+		l, r := record(n, 0), record(n, 1)
+		var b []byte
+		switch opts.RecordSize {
+		case 24:
+			b = []byte{byte(l >> 16), byte(l >> 8), byte(l), byte(r >> 16), byte(r >> 8), byte(r)}
+		case 28:
+			b = []byte{byte(l >> 16), byte(l >> 8), byte(l), byte(l>>24)<<4 | byte(r>>24)&0x0f, byte(r >> 16), byte(r >> 8), byte(r)}
+		case 32:
+			b = []byte{byte(l >> 24), byte(l >> 16), byte(l >> 8), byte(l), byte(r >> 24), byte(r >> 16), byte(r >> 8), byte(r)}
+		}
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+
+	// the data section separator
+	if _, err := w.Write(make([]byte, 16)); err != nil {
+		return err
+	}
+
+	if _, err := w.Write(data.Bytes()); err != nil {
+		return err
+	}
+
+	if _, err := w.Write(mmdbMetadataStart); err != nil {
+		return err
+	}
+
+	var meta mmdbEncoder
+	meta.control(mmdbMap, 9)
+	meta.putString("binary_format_major_version")
+	meta.putUint(mmdbUint16, 2)
+	meta.putString("binary_format_minor_version")
+	meta.putUint(mmdbUint16, 0)
+	meta.putString("build_epoch")
+	meta.putUint(mmdbUint64, uint64(opts.BuildEpoch.Unix()))
+	meta.putString("database_type")
+	meta.putString(opts.DatabaseType)
+	meta.putString("description")
+	meta.control(mmdbMap, 1)
+	meta.putString("en")
+	meta.putString(opts.Description)
+	meta.putString("ip_version")
+	meta.putUint(mmdbUint16, uint64(ipVersion))
+	meta.putString("languages")
+	meta.control(mmdbArray, 1)
+	meta.putString("en")
+	meta.putString("node_count")
+	meta.putUint(mmdbUint32, uint64(nodeCount))
+	meta.putString("record_size")
+	meta.putUint(mmdbUint16, uint64(opts.RecordSize))
+
+	if _, err := w.Write(meta.Bytes()); err != nil {
+		return err
+	}
+
+	return w.Flush()
+}
+
+// mmdbRecord is the record written by writeMMDB
+type mmdbRecord struct {
+	UFI        *int32  `maxminddb:"ufi"`
+	Confidence float32 `maxminddb:"confidence"`
+	Source     string  `maxminddb:"source"`
+	Label      string  `maxminddb:"label"`
+}
+
+func (rec mmdbRecord) value() rangeValue {
+	return rangeValue{UFI: *rec.UFI, Confidence: rec.Confidence, Source: rec.Source, Label: rec.Label}
+}
+
+// loadIPRangesFromMMDB reads the record of every network in a MaxMind DB
+// file.  Networks without a ufi field are skipped.
+func loadIPRangesFromMMDB(fname string) (rangeSet, error) {
+	db, err := maxminddb.Open(fname)
+	if err != nil {
+		return rangeSet{}, err
+	}
+	defer db.Close()
+
+	var ranges rangeSet
+	var values valueTableBuilder
+
+	networks := db.Networks(maxminddb.SkipAliasedNetworks)
+	for networks.Next() {
+		var rec mmdbRecord
+		n, err := networks.Network(&rec)
+		if err != nil {
+			return rangeSet{}, err
+		}
+
+		if rec.UFI == nil {
+			continue
+		}
+
+		data := values.add(rec.value())
+		from, to := netRange(n)
+		if len(from) == net.IPv4len {
+			ranges.v4 = append(ranges.v4, ipRange{rangeFrom: binary.BigEndian.Uint32(from), rangeTo: binary.BigEndian.Uint32(to), data: data})
+		} else {
+			ranges.v6 = append(ranges.v6, ipRange6{rangeFrom: uint128FromIP(from), rangeTo: uint128FromIP(to), data: data})
+		}
+	}
+
+	if err := networks.Err(); err != nil {
+		return rangeSet{}, err
+	}
+	ranges.table = values.table
+
+	// the tree splits ranges into prefixes
+	return ranges.compact(), nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	maxminddb "github.com/oschwald/maxminddb-golang"
+)
+
+func TestWriteMMDB(t *testing.T) {
+	v4 := ipRangeList{
+		{0x01000000, 0x010000ff, 100},
+		{0x01000100, 0x010001ff, -5},
+		{0x01000203, 0x01000310, 1 << 20},
+		{0xfffffff0, 0xffffffff, 102},
+	}
+	v6 := ipRange6List{
+		{uint128{0, 0}, uint128{0x20010db8<<32 - 1, ^uint64(0)}, 1}, // covers ::/96, which is replaced by the IPv4 ranges
+		{uint128{0x20010db8 << 32, 0x10}, uint128{0x20010db8 << 32, 0x1000}, 200},
+	}
+
+	tests := []struct {
+		ip  string
+		ufi int32
+		ok  bool
+	}{
+		{"1.0.0.0", 100, true},
+		{"1.0.0.255", 100, true},
+		{"1.0.1.17", -5, true},
+		{"1.0.2.2", 0, false},
+		{"1.0.2.3", 1 << 20, true},
+		{"1.0.3.16", 1 << 20, true},
+		{"1.0.3.17", 0, false},
+		{"255.255.255.255", 102, true},
+		{"8.8.8.8", 0, false},
+	}
+
+	tests6 := []struct {
+		ip  string
+		ufi int32
+		ok  bool
+	}{
+		{"::ffff:1.0.0.1", 100, true},
+		{"::1.0.0.1", 100, true},
+		{"::8.8.8.8", 0, false},
+		{"1::", 1, true},
+		{"2001:db8::f", 0, false},
+		{"2001:db8::10", 200, true},
+		{"2001:db8::1000", 200, true},
+		{"2001:db8::1001", 0, false},
+	}
+
+	for _, withV6 := range []bool{false, true} {
+		for _, recordSize := range []int{24, 28, 32} {
+			set := rangeSet{v4: v4}
+			if withV6 {
+				set.v6 = v6
+			}
+
+			var buf bytes.Buffer
+			err := writeMMDB(&buf, set, mmdbOptions{
+				RecordSize:   recordSize,
+				DatabaseType: "IP2UFI",
+				Description:  "test",
+				BuildEpoch:   time.Unix(1500000000, 0),
+			})
+			if err != nil {
+				t.Fatalf("writeMMDB(%d, %v): %s", recordSize, withV6, err)
+			}
+
+			db, err := maxminddb.FromBytes(buf.Bytes())
+			if err != nil {
+				t.Fatalf("FromBytes(%d, %v): %s", recordSize, withV6, err)
+			}
+
+			if err := db.Verify(); err != nil {
+				t.Errorf("Verify(%d, %v): %s", recordSize, withV6, err)
+			}
+
+			wantVersion := uint(4)
+			if withV6 {
+				wantVersion = 6
+			}
+			if m := db.Metadata; m.IPVersion != wantVersion || m.RecordSize != uint(recordSize) || m.DatabaseType != "IP2UFI" || m.BuildEpoch != 1500000000 || m.Description["en"] != "test" {
+				t.Errorf("unexpected metadata %+v", m)
+			}
+
+			check := func(ip string, want int32, wantOk bool) {
+				var rec struct {
+					UFI *int32 `maxminddb:"ufi"`
+				}
+				if err := db.Lookup(net.ParseIP(ip), &rec); err != nil {
+					t.Errorf("Lookup(%s): %s", ip, err)
+					return
+				}
+				if (rec.UFI != nil) != wantOk || (wantOk && *rec.UFI != want) {
+					t.Errorf("record size %d, v6 %v: Lookup(%s)=%v, want %d (%v)", recordSize, withV6, ip, rec.UFI, want, wantOk)
+				}
+			}
+
+			for _, tt := range tests {
+				check(tt.ip, tt.ufi, tt.ok)
+			}
+			if withV6 {
+				for _, tt := range tests6 {
+					check(tt.ip, tt.ufi, tt.ok)
+				}
+			}
+		}
+	}
+}
+
+func TestLoadIPRangesFromMMDB(t *testing.T) {
+	set := rangeSet{
+		v4: ipRangeList{
+			{0x01000000, 0x010000ff, 0},
+			{0x01000100, 0x010001ff, 0},
+			{0x01000203, 0x01000310, 1},
+		},
+		v6: ipRange6List{
+			{uint128{0x20010db8 << 32, 0x10}, uint128{0x20010db8 << 32, 0x1000}, 2},
+		},
+		table: valueTable{
+			{UFI: 100, Confidence: 0.5, Source: "survey"},
+			{UFI: 101},
+			{UFI: -200, Label: "guess"},
+		},
+	}
+
+	tempFile, err := ioutil.TempFile("", "rgipMMDB")
+	if err != nil {
+		t.Fatalf("couldn't create temp file")
+	}
+	defer os.Remove(tempFile.Name())
+
+	err = writeMMDB(tempFile, set, mmdbOptions{RecordSize: 28, DatabaseType: "IP2UFI", BuildEpoch: time.Now()})
+	tempFile.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := loadIPRangesFromMMDB(tempFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := set.compact(); !reflect.DeepEqual(loaded, want) {
+		t.Errorf("loaded %v, want %v", loaded, want)
+	}
+}
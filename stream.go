@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+
+	"github.com/dgryski/rgip/mlog"
+)
+
+// maxStreamLine bounds the length of a line of input to /stream
+const maxStreamLine = 64 << 10
+
+var errLineTooLong = errors.New("line too long")
+
+// streamIP returns the address on a line of input: either the whole line,
+// or the ip field of a JSON object
+func streamIP(line []byte) (string, error) {
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 || line[0] != '{' {
+		return string(line), nil
+	}
+
+	var obj struct {
+		IP string `json:"ip"`
+	}
+	if err := json.Unmarshal(line, &obj); err != nil {
+		return "", err
+	}
+	return obj.IP, nil
+}
+
+// enrichStream looks up the address on each line of in, writing a line of
+// JSON with its IPInfo to out.  out is flushed, and then flush called,
+// whenever no more input is buffered, so results reach the client while it's
+// still sending.  Lines are handled one at a time, so a client that stops
+// reading results stops more input being read.  It returns the number of
+// lines handled.
+func enrichStream(in io.Reader, out *bufio.Writer, flush func() error, fields fieldSet) (int, error) {
+	br := bufio.NewReaderSize(in, maxStreamLine)
+	encoder := json.NewEncoder(out)
+
+	var n int
+	for {
+		if br.Buffered() == 0 {
+			if err := out.Flush(); err != nil {
+				return n, err
+			}
+			if err := flush(); err != nil {
+				return n, err
+			}
+		}
+
+		line, err := br.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			// skip the rest of the line
+			for err == bufio.ErrBufferFull {
+				_, err = br.ReadSlice('\n')
+			}
+			line = nil
+			countError("stream", "bad_line")
+			if e := encoder.Encode(IPInfo{IPStatus: "ParseError"}.selectFields(fields)); e != nil {
+				return n, e
+			}
+			n++
+		}
+
+		if len(bytes.TrimSpace(line)) > 0 {
+			ipinfo := streamLookup(line, fields)
+			if e := encoder.Encode(ipinfo.selectFields(fields)); e != nil {
+				return n, e
+			}
+			n++
+		}
+
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+
+	return n, out.Flush()
+}
+
+// streamLookup looks up the address on a line of input
+func streamLookup(line []byte, fields fieldSet) IPInfo {
+	ip, err := streamIP(line)
+	if err != nil {
+		countError("stream", "bad_line")
+		return IPInfo{IPStatus: "ParseError"}
+	}
+
+	// each lookup uses the current generation, so a long stream doesn't
+	// keep an old one from being released
+	gen := acquireGeneration()
+	defer gen.release()
+
+	ipinfo, err := gen.lookupIPInfoFields(ip, fields)
+	if err != nil {
+		countError("stream", "parse_error")
+		return IPInfo{IP: ip, IPStatus: "ParseError"}
+	}
+	ipinfo.IPStatus = "OK"
+	return ipinfo
+}
+
+// streamHandler reads newline-delimited addresses, or JSON objects with an
+// ip field, from the request body and streams back a line of JSON with the
+// IPInfo of each, in order, as they're looked up.
+func streamHandler(w http.ResponseWriter, r *http.Request) {
+
+	Metrics.Requests.Add(1)
+
+	if r.Method != "POST" {
+		countError("stream", "bad_method")
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	fields, err := requestFields(r)
+	if err != nil {
+		countError("stream", "bad_fields")
+		mlog.Println("error parsing fields:", r.URL, ":", err)
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	// an HTTP/1.x body without a length runs to the end of the connection,
+	// which the response is sent on
+	if r.ProtoMajor == 1 && r.ContentLength < 0 && !chunkedBody(r) {
+		countError("stream", "no_length")
+		http.Error(w, "", http.StatusLengthRequired)
+		return
+	}
+
+	var n int
+	if r.ProtoMajor == 1 {
+		n, err = streamHTTP1(w, r, fields)
+	} else {
+		// HTTP/2 streams are full duplex
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		out := bufio.NewWriter(w)
+		n, err = enrichStream(r.Body, out, func() error {
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+			return nil
+		}, fields)
+	}
+
+	prom.batchSize.observe(float64(n), "stream")
+	if err != nil {
+		countError("stream", "io_error")
+		mlog.Println("error streaming to", r.RemoteAddr, "after", n, "lines:", err)
+	}
+}
+
+// chunkedBody reports whether the request body has chunked transfer encoding
+func chunkedBody(r *http.Request) bool {
+	return len(r.TransferEncoding) > 0 && strings.EqualFold(r.TransferEncoding[0], "chunked")
+}
+
+// streamHTTP1 runs enrichStream over an HTTP/1.x connection.  The server
+// won't let a handler read the rest of the request body once it's started
+// writing the response, so the connection is taken over and the response
+// written directly.
+func streamHTTP1(w http.ResponseWriter, r *http.Request, fields fieldSet) (int, error) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "", http.StatusInternalServerError)
+		return 0, errors.New("connection can't be hijacked")
+	}
+
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	// rw.Reader may hold the start of the body
+	var body io.Reader
+	if chunkedBody(r) {
+		body = httputil.NewChunkedReader(rw.Reader)
+	} else {
+		body = io.LimitReader(rw.Reader, r.ContentLength)
+	}
+
+	if strings.EqualFold(r.Header.Get("Expect"), "100-continue") {
+		fmt.Fprint(rw, "HTTP/1.1 100 Continue\r\n\r\n")
+	}
+	fmt.Fprint(rw, "HTTP/1.1 200 OK\r\nContent-Type: application/x-ndjson\r\nTransfer-Encoding: chunked\r\nConnection: close\r\n\r\n")
+
+	chunked := httputil.NewChunkedWriter(rw.Writer)
+	n, err := enrichStream(body, bufio.NewWriter(chunked), rw.Writer.Flush, fields)
+	if err != nil {
+		return n, err
+	}
+
+	// the last chunk, and an empty trailer
+	if err := chunked.Close(); err != nil {
+		return n, err
+	}
+	if _, err := io.WriteString(rw, "\r\n"); err != nil {
+		return n, err
+	}
+	return n, rw.Flush()
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestEnrichStream(t *testing.T) {
+	swapGeneration(testGeneration())
+
+	in := "1.2.3.4\n\n{\"ip\": \"1.2.3.4\", \"user\": 3}\nbogus\n{\"ip\": \n" + strings.Repeat("x", maxStreamLine+1) + "\n1.2.3.4"
+	var out bytes.Buffer
+	var flushes int
+	n, err := enrichStream(strings.NewReader(in), bufio.NewWriter(&out), func() error { flushes++; return nil }, allFields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 6 {
+		t.Errorf("handled %d lines, want 6", n)
+	}
+	if flushes == 0 {
+		t.Errorf("output never flushed")
+	}
+
+	d := json.NewDecoder(&out)
+	for i, want := range []struct {
+		ip, status string
+		ufi        int32
+	}{
+		{"1.2.3.4", "OK", 7},
+		{"1.2.3.4", "OK", 7},
+		{"bogus", "ParseError", 0},
+		{"", "ParseError", 0},
+		{"", "ParseError", 0},
+		{"1.2.3.4", "OK", 7},
+	} {
+		var r IPInfo
+		if err := d.Decode(&r); err != nil {
+			t.Fatalf("result %d: %s", i, err)
+		}
+		if r.IP != want.ip || r.IPStatus != want.status || r.UFI.GuessedUFI != want.ufi {
+			t.Errorf("result %d=%+v, want %+v", i, r, want)
+		}
+	}
+}
+
+func TestStreamHandler(t *testing.T) {
+	swapGeneration(testGeneration())
+
+	srv := httptest.NewServer(http.HandlerFunc(streamHandler))
+	defer srv.Close()
+
+	// each result should arrive while the request body is still open
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	go io.WriteString(pw, "1.2.3.4\n")
+
+	resp, err := http.Post(srv.URL, "text/plain", pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("Content-Type %q", ct)
+	}
+
+	d := json.NewDecoder(resp.Body)
+	for _, line := range []string{"", "{\"ip\": \"1.2.3.4\"}\n", "1.2.3.5\n"} {
+		if line != "" {
+			if _, err := io.WriteString(pw, line); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var r IPInfo
+		if err := d.Decode(&r); err != nil {
+			t.Fatal(err)
+		}
+		if r.IPStatus != "OK" || r.UFI.GuessedUFI != 7 {
+			t.Errorf("result %+v, want UFI 7", r)
+		}
+	}
+	pw.Close()
+
+	var r IPInfo
+	if err := d.Decode(&r); err != io.EOF {
+		t.Errorf("expected end of stream, got %+v, %v", r, err)
+	}
+}
+
+func TestStreamHandlerNoLength(t *testing.T) {
+	r := httptest.NewRequest("POST", "/stream", strings.NewReader("1.2.3.4\n"))
+	r.ContentLength = -1
+	w := httptest.NewRecorder()
+	streamHandler(w, r)
+	if w.Code != http.StatusLengthRequired {
+		t.Errorf("status %d, want %d", w.Code, http.StatusLengthRequired)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"math/big"
+	"net"
+)
+
+// ufiIndex maps UFIs back to the ranges assigned to them
+type ufiIndex map[int32]*rangeSet
+
+func buildUFIIndex(ranges rangeLookuper) ufiIndex {
+	index := make(ufiIndex)
+
+	entry := func(ufi int32) *rangeSet {
+		s, ok := index[ufi]
+		if !ok {
+			s = new(rangeSet)
+			index[ufi] = s
+		}
+		return s
+	}
+
+	// the indexed ranges hold their UFI, so ranges differing only in other
+	// fields of their value can be coalesced
+	table := ranges.values()
+	ranges.walk(
+		func(r ipRange) {
+			r.data = table.get(r.data).UFI
+			s := entry(r.data)
+			s.v4 = append(s.v4, r)
+		},
+		func(r ipRange6) {
+			r.data = table.get(r.data).UFI
+			s := entry(r.data)
+			s.v6 = append(s.v6, r)
+		},
+	)
+
+	// sharding splits ranges at /8 boundaries
+	for ufi, s := range index {
+		c := s.compact()
+		index[ufi] = &c
+	}
+
+	return index
+}
+
+// UFIRange is a range of addresses assigned to a UFI
+type UFIRange struct {
+	Start string   `json:"start"`
+	End   string   `json:"end"`
+	CIDRs []string `json:"cidrs"`
+}
+
+// UFIRanges is the response type for reverse lookups
+type UFIRanges struct {
+	UFI       int32      `json:"ufi"`
+	Ranges    []UFIRange `json:"ranges"`
+	Addresses *big.Int   `json:"addresses"`
+}
+
+func newUFIRanges(ufi int32, s *rangeSet) UFIRanges {
+	resp := UFIRanges{
+		UFI:       ufi,
+		Ranges:    []UFIRange{},
+		Addresses: new(big.Int),
+	}
+
+	add := func(from, to net.IP, nets []*net.IPNet, size *big.Int) {
+		r := UFIRange{Start: from.String(), End: to.String()}
+		for _, n := range nets {
+			r.CIDRs = append(r.CIDRs, n.String())
+		}
+		resp.Ranges = append(resp.Ranges, r)
+		resp.Addresses.Add(resp.Addresses, size)
+	}
+
+	for _, r := range s.v4 {
+		add(uint32ToIP(r.rangeFrom), uint32ToIP(r.rangeTo), r.cidrs(), rangeSize(uint128{0, uint64(r.rangeFrom)}, uint128{0, uint64(r.rangeTo)}))
+	}
+	for _, r := range s.v6 {
+		add(r.rangeFrom.IP(), r.rangeTo.IP(), r.cidrs(), rangeSize(r.rangeFrom, r.rangeTo))
+	}
+
+	return resp
+}
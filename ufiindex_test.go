@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestUFIIndex(t *testing.T) {
+	set := rangeSet{
+		v4: ipRangeList{
+			{0x01000000, 0x010000ff, 100},
+			{0x01000100, 0x01000100, 101},
+			{0x01ffff00, 0x020000ff, 100},
+		},
+		v6: ipRange6List{
+			{uint128{0x20010db8 << 32, 0}, uint128{0x20010db8 << 32, 0xff}, 100},
+		},
+	}
+
+	sharded, err := set.shard()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ranges := range []rangeLookuper{set, sharded} {
+		index := buildUFIIndex(ranges)
+
+		if len(index) != 2 {
+			t.Fatalf("%T: index has %d entries, want 2", ranges, len(index))
+		}
+
+		b, _ := json.Marshal(newUFIRanges(100, index[100]))
+		want := `{"ufi":100,"ranges":[` +
+			`{"start":"1.0.0.0","end":"1.0.0.255","cidrs":["1.0.0.0/24"]},` +
+			`{"start":"1.255.255.0","end":"2.0.0.255","cidrs":["1.255.255.0/24","2.0.0.0/24"]},` +
+			`{"start":"2001:db8::","end":"2001:db8::ff","cidrs":["2001:db8::/120"]}` +
+			`],"addresses":1024}`
+		if string(b) != want {
+			t.Errorf("%T: got  %s\nwant %s", ranges, b, want)
+		}
+	}
+}
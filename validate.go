@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+)
+
+// rangeProblem is an issue found while validating a range list
+type rangeProblem struct {
+	Fatal   bool   // Fatal problems cause lookups to return wrong answers
+	Range   string // Range identifies the offending range
+	Message string
+}
+
+func (p rangeProblem) String() string {
+	severity := "warning"
+	if p.Fatal {
+		severity = "error"
+	}
+	return fmt.Sprintf("%s: %s: %s", severity, p.Range, p.Message)
+}
+
+// rangeReport is the result of validating a range list
+type rangeReport struct {
+	Problems []rangeProblem
+
+	Ranges    int    // Ranges is the number of IPv4 ranges
+	Covered   uint64 // Covered is the number of IPv4 addresses that have a value
+	Gaps      int    // Gaps is the number of unmapped IPv4 gaps between ranges
+	GapAddrs  uint64 // GapAddrs is the number of IPv4 addresses in the gaps
+	Ranges6   int    // Ranges6 is the number of IPv6 ranges
+	Gaps6     int    // Gaps6 is the number of unmapped IPv6 gaps between ranges
+	Values    int    // Values is the number of distinct values
+	ZeroUFIs  int    // ZeroUFIs is the number of ranges with a UFI of zero
+	Reserved4 int    // Reserved4 is the number of IPv4 ranges with a value in reserved space
+	Reserved6 int    // Reserved6 is the number of IPv6 ranges with a value in reserved space
+}
+
+// errors returns the number of fatal problems
+func (r *rangeReport) errors() int {
+	var n int
+	for _, p := range r.Problems {
+		if p.Fatal {
+			n++
+		}
+	}
+	return n
+}
+
+func (r *rangeReport) add(fatal bool, rng, format string, a ...interface{}) {
+	r.Problems = append(r.Problems, rangeProblem{Fatal: fatal, Range: rng, Message: fmt.Sprintf(format, a...)})
+}
+
+// reservedNets are address blocks which shouldn't be mapped to a location
+var reservedNets = mustParseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.2.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"198.51.100.0/24",
+	"203.0.113.0/24",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"2001:db8::/32",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// reservedOverlap returns the first reserved block overlapping from-to, or nil
+func reservedOverlap(from, to net.IP) *net.IPNet {
+	for _, n := range reservedNets {
+		if len(n.IP) != len(from) {
+			continue
+		}
+
+		last := make(net.IP, len(n.IP))
+		for i := range n.IP {
+			last[i] = n.IP[i] | ^n.Mask[i]
+		}
+
+		if compareIP(from, last) <= 0 && compareIP(n.IP, to) <= 0 {
+			return n
+		}
+	}
+	return nil
+}
+
+func compareIP(a, b net.IP) int {
+	for i := range a {
+		if a[i] != b[i] {
+			if a[i] < b[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+func uint32ToIP(ip32 uint32) net.IP {
+	return net.IPv4(byte(ip32>>24), byte(ip32>>16), byte(ip32>>8), byte(ip32)).To4()
+}
+
+// validateRanges checks that the ranges are sorted, don't overlap and have
+// sensible values, and gathers coverage statistics
+func validateRanges(ranges rangeLookuper) *rangeReport {
+	r := new(rangeReport)
+
+	table := ranges.values()
+	values := make(map[int32]struct{})
+
+	// checkValue returns the UFI of a range's data
+	checkValue := func(rng string, data int32) int32 {
+		if table != nil && (data < 0 || int(data) >= len(table)) {
+			r.add(true, rng, "value %d not in table of %d values", data, len(table))
+			return 0
+		}
+
+		ufi := table.get(data).UFI
+		values[ufi] = struct{}{}
+		switch {
+		case ufi < 0:
+			r.add(true, rng, "negative UFI %d", ufi)
+		case ufi == 0:
+			r.ZeroUFIs++
+		}
+		return ufi
+	}
+
+	// prev4 and prev6 are the last ranges walked
+	var prev4 ipRange
+	var prev6 ipRange6
+	sorted4, sorted6 := true, true
+
+	fn4 := func(v ipRange) {
+		i, prev := r.Ranges, prev4
+		r.Ranges++
+		prev4 = v
+
+		if i > 0 {
+			if v.rangeTo < prev.rangeTo {
+				sorted4 = false
+			} else if v.rangeFrom > prev.rangeTo && v.rangeFrom-prev.rangeTo > 1 {
+				r.Gaps++
+				r.GapAddrs += uint64(v.rangeFrom - prev.rangeTo - 1)
+			}
+		}
+
+		rng := fmt.Sprintf("IPv4 range %d (%s-%s)", i, uint32ToIP(v.rangeFrom), uint32ToIP(v.rangeTo))
+
+		if v.rangeFrom > v.rangeTo {
+			r.add(true, rng, "range ends before it starts")
+			return
+		}
+
+		if i > 0 {
+			switch {
+			case v.rangeTo < prev.rangeTo:
+				r.add(true, rng, "out of order, previous range ends at %s", uint32ToIP(prev.rangeTo))
+			case v.rangeFrom <= prev.rangeTo:
+				r.add(true, rng, "overlaps previous range ending at %s", uint32ToIP(prev.rangeTo))
+			}
+		}
+
+		ufi := checkValue(rng, v.data)
+		r.Covered += uint64(v.rangeTo-v.rangeFrom) + 1
+
+		if ufi != 0 {
+			if n := reservedOverlap(uint32ToIP(v.rangeFrom), uint32ToIP(v.rangeTo)); n != nil {
+				r.Reserved4++
+				r.add(false, rng, "UFI %d assigned to reserved block %s", ufi, n)
+			}
+		}
+	}
+
+	fn6 := func(v ipRange6) {
+		i, prev := r.Ranges6, prev6
+		r.Ranges6++
+		prev6 = v
+
+		if i > 0 {
+			if v.rangeTo.less(prev.rangeTo) {
+				sorted6 = false
+			} else if prev.rangeTo.incr().less(v.rangeFrom) {
+				r.Gaps6++
+			}
+		}
+
+		rng := fmt.Sprintf("IPv6 range %d (%s-%s)", i, v.rangeFrom.IP(), v.rangeTo.IP())
+
+		if v.rangeTo.less(v.rangeFrom) {
+			r.add(true, rng, "range ends before it starts")
+			return
+		}
+
+		if i > 0 {
+			switch {
+			case v.rangeTo.less(prev.rangeTo):
+				r.add(true, rng, "out of order, previous range ends at %s", prev.rangeTo.IP())
+			case v.rangeFrom.lessEq(prev.rangeTo):
+				r.add(true, rng, "overlaps previous range ending at %s", prev.rangeTo.IP())
+			}
+		}
+
+		ufi := checkValue(rng, v.data)
+
+		if ufi != 0 {
+			if n := reservedOverlap(v.rangeFrom.IP(), v.rangeTo.IP()); n != nil {
+				r.Reserved6++
+				r.add(false, rng, "UFI %d assigned to reserved block %s", ufi, n)
+			}
+		}
+	}
+
+	ranges.walk(fn4, fn6)
+
+	// gaps only make sense if the ranges are in order
+	if !sorted4 {
+		r.Gaps, r.GapAddrs = 0, 0
+	}
+	if !sorted6 {
+		r.Gaps6 = 0
+	}
+
+	r.Values = len(values)
+
+	return r
+}
+
+// firstError returns the first fatal problem, if any
+func (r *rangeReport) firstError() (rangeProblem, bool) {
+	for _, p := range r.Problems {
+		if p.Fatal {
+			return p, true
+		}
+	}
+	return rangeProblem{}, false
+}
+
+func (r *rangeReport) write(w io.Writer) {
+	for _, p := range r.Problems {
+		fmt.Fprintln(w, p)
+	}
+
+	fmt.Fprintf(w, "IPv4 ranges: %d\n", r.Ranges)
+	fmt.Fprintf(w, "IPv4 addresses covered: %d (%.2f%%)\n", r.Covered, 100*float64(r.Covered)/(1<<32))
+	fmt.Fprintf(w, "IPv4 gaps: %d (%d addresses)\n", r.Gaps, r.GapAddrs)
+	fmt.Fprintf(w, "IPv6 ranges: %d\n", r.Ranges6)
+	fmt.Fprintf(w, "IPv6 gaps: %d\n", r.Gaps6)
+	fmt.Fprintf(w, "distinct UFIs: %d\n", r.Values)
+	fmt.Fprintf(w, "ranges with UFI 0: %d\n", r.ZeroUFIs)
+	fmt.Fprintf(w, "ranges in reserved space: %d IPv4, %d IPv6\n", r.Reserved4, r.Reserved6)
+	fmt.Fprintf(w, "errors: %d, warnings: %d\n", r.errors(), len(r.Problems)-r.errors())
+}
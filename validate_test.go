@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateRanges(t *testing.T) {
+	set := rangeSet{
+		v4: ipRangeList{
+			{0x01000000, 0x010000ff, 100},
+			{0x01000100, 0x010001ff, 0},
+			{0x010001f0, 0x010002ff, 101}, // overlaps
+			{0x01000000, 0x010000ff, 102}, // out of order
+			{0x0a000000, 0x0a0000ff, 103}, // reserved
+			{0x0b000000, 0x0b0000ff, -1},  // negative
+		},
+		v6: ipRange6List{
+			{uint128{0x20010db8 << 32, 0}, uint128{0x20010db8 << 32, 0xffff}, 200}, // reserved
+			{uint128{0x2a000000 << 32, 0}, uint128{0x2a000000 << 32, 0xffff}, 201},
+		},
+	}
+
+	r := validateRanges(set)
+
+	var errors, warnings []string
+	for _, p := range r.Problems {
+		if p.Fatal {
+			errors = append(errors, p.String())
+		} else {
+			warnings = append(warnings, p.String())
+		}
+	}
+
+	wantErrors := []string{"overlaps previous", "out of order", "negative UFI -1"}
+	if len(errors) != len(wantErrors) {
+		t.Fatalf("errors=%q, want %d", errors, len(wantErrors))
+	}
+	for i, want := range wantErrors {
+		if !strings.Contains(errors[i], want) {
+			t.Errorf("error %d=%q, want %q", i, errors[i], want)
+		}
+	}
+
+	if len(warnings) != 2 || !strings.Contains(warnings[0], "10.0.0.0/8") || !strings.Contains(warnings[1], "2001:db8::/32") {
+		t.Errorf("warnings=%q", warnings)
+	}
+
+	if r.ZeroUFIs != 1 || r.Values != 8 || r.Reserved4 != 1 || r.Reserved6 != 1 {
+		t.Errorf("unexpected report %+v", r)
+	}
+
+	clean := validateRanges(rangeSet{v4: set.v4[:2], v6: set.v6[1:]})
+	if clean.errors() != 0 || len(clean.Problems) != 0 {
+		t.Errorf("unexpected problems %v", clean.Problems)
+	}
+	if clean.Covered != 512 {
+		t.Errorf("covered=%d, want 512", clean.Covered)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+)
+
+// rangeValue is the record attached to a range
+type rangeValue struct {
+	UFI        int32
+	Confidence float32
+	Source     string
+	Label      string
+}
+
+// valueTable holds the distinct records of a range list, indexed by the data
+// field of each range.  A nil table means each range's data is its UFI.
+type valueTable []rangeValue
+
+// get returns the record for a range's data
+func (t valueTable) get(data int32) rangeValue {
+	if t == nil {
+		return rangeValue{UFI: data}
+	}
+	if data < 0 || int(data) >= len(t) {
+		return rangeValue{}
+	}
+	return t[data]
+}
+
+// valueTableBuilder deduplicates records as they are added to a table
+type valueTableBuilder struct {
+	table valueTable
+	index map[rangeValue]int32
+}
+
+// add returns the index of v in the table, adding it if needed
+func (b *valueTableBuilder) add(v rangeValue) int32 {
+	if b.index == nil {
+		b.index = make(map[rangeValue]int32)
+	}
+	i, ok := b.index[v]
+	if !ok {
+		i = int32(len(b.table))
+		b.table = append(b.table, v)
+		b.index[v] = i
+	}
+	return i
+}
+
+// csvFields are the column names accepted in a CSV layout
+var csvFields = map[string]bool{
+	"from":       true,
+	"to":         true,
+	"cidr":       true,
+	"ufi":        true,
+	"confidence": true,
+	"source":     true,
+	"label":      true,
+	"-":          true,
+}
+
+// checkColumns verifies a CSV layout names known fields, and enough of them to make a range
+func checkColumns(columns []string) error {
+	seen := make(map[string]bool)
+	for _, c := range columns {
+		if !csvFields[c] {
+			return fmt.Errorf("unknown CSV column %q", c)
+		}
+		if seen[c] && c != "-" {
+			return fmt.Errorf("duplicate CSV column %q", c)
+		}
+		seen[c] = true
+	}
+
+	if !seen["ufi"] {
+		return fmt.Errorf("CSV layout has no ufi column")
+	}
+	if !seen["to"] && !seen["cidr"] {
+		return fmt.Errorf("CSV layout needs a to or cidr column")
+	}
+	if seen["cidr"] && (seen["from"] || seen["to"]) {
+		return fmt.Errorf("CSV layout can't have both cidr and from/to columns")
+	}
+	return nil
+}
+
+func (c *converr) float(s string) float32 {
+	f, e := strconv.ParseFloat(s, 32)
+	if e != nil {
+		c.err = e
+		return 0
+	}
+	return float32(f)
+}
+
+func writeValueTable(w io.Writer, t valueTable) error {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], uint32(len(t)))
+	if _, err := w.Write(b[:]); err != nil {
+		return err
+	}
+
+	for _, v := range t {
+		binary.LittleEndian.PutUint32(b[:], uint32(v.UFI))
+		if _, err := w.Write(b[:]); err != nil {
+			return err
+		}
+		binary.LittleEndian.PutUint32(b[:], math.Float32bits(v.Confidence))
+		if _, err := w.Write(b[:]); err != nil {
+			return err
+		}
+		for _, s := range []string{v.Source, v.Label} {
+			if len(s) > maxSourceLen {
+				return fmt.Errorf("string too long: %d bytes", len(s))
+			}
+			binary.LittleEndian.PutUint32(b[:], uint32(len(s)))
+			if _, err := w.Write(b[:]); err != nil {
+				return err
+			}
+			if _, err := io.WriteString(w, s); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func readValueTable(r io.Reader) (valueTable, error) {
+	var b [4]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return nil, fmt.Errorf("can't read value table size field %s", err)
+	}
+
+	n := binary.LittleEndian.Uint32(b[:])
+	if n == 0 {
+		return nil, nil
+	}
+
+	t := make(valueTable, 0, preallocLen(n))
+	for i := uint32(0); i < n; i++ {
+		var v rangeValue
+
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return nil, fmt.Errorf("expected %d values, got %d", n, i)
+		}
+		v.UFI = int32(binary.LittleEndian.Uint32(b[:]))
+
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return nil, fmt.Errorf("expected %d values, got %d", n, i)
+		}
+		v.Confidence = math.Float32frombits(binary.LittleEndian.Uint32(b[:]))
+
+		for _, s := range []*string{&v.Source, &v.Label} {
+			if _, err := io.ReadFull(r, b[:]); err != nil {
+				return nil, fmt.Errorf("expected %d values, got %d", n, i)
+			}
+			l := binary.LittleEndian.Uint32(b[:])
+			if l > maxSourceLen {
+				return nil, fmt.Errorf("value %d: string too long: %d bytes", i, l)
+			}
+			buf := make([]byte, l)
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return nil, fmt.Errorf("expected %d values, got %d", n, i)
+			}
+			*s = string(buf)
+		}
+
+		t = append(t, v)
+	}
+
+	return t, nil
+}
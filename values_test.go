@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCSVColumns(t *testing.T) {
+	csv := `x,1.0.0.0,1.0.0.255,100,0.9,survey,office
+x,1.0.1.0,1.0.1.255,100,0.9,survey,office
+x,1.0.2.0,1.0.2.255,101,0.25,,
+x,2001:db8::,2001:db8::ffff,200,1,feed,
+`
+	columns := []string{"-", "from", "to", "ufi", "confidence", "source", "label"}
+	set, err := loadIPRangesFromCSVColumns(strings.NewReader(csv), columns)
+	if err != nil {
+		t.Fatalf("couldn't parse CSV: %s", err)
+	}
+
+	want := rangeSet{
+		v4: ipRangeList{
+			{0x01000000, 0x010000ff, 0},
+			{0x01000100, 0x010001ff, 0},
+			{0x01000200, 0x010002ff, 1},
+		},
+		v6: ipRange6List{
+			{uint128{0x20010db8 << 32, 0}, uint128{0x20010db8 << 32, 0xffff}, 2},
+		},
+		table: valueTable{
+			{UFI: 100, Confidence: 0.9, Source: "survey", Label: "office"},
+			{UFI: 101, Confidence: 0.25},
+			{UFI: 200, Confidence: 1, Source: "feed"},
+		},
+	}
+
+	if !reflect.DeepEqual(set, want) {
+		t.Errorf("got %v, want %v", set, want)
+	}
+
+	var ipr ipRanges
+	ipr.swap(set)
+	ipr.setIndex(buildUFIIndex(set))
+	if v, ok := ipr.lookup(0x01000280); !ok || v != want.table[1] {
+		t.Errorf("lookup=(%+v, %v), want (%+v, true)", v, ok, want.table[1])
+	}
+	if s := ipr.reverse(100); s == nil || len(s.v4) != 1 {
+		t.Errorf("reverse(100)=%v, want one coalesced range", s)
+	}
+
+	for _, bad := range [][]string{
+		{"from", "to"},
+		{"to", "ufi", "ufi"},
+		{"cidr", "to", "ufi"},
+		{"to", "ufi", "colour"},
+	} {
+		if err := checkColumns(bad); err == nil {
+			t.Errorf("expected error for columns %q", bad)
+		}
+	}
+
+	if _, err := loadIPRangesFromCSVColumns(strings.NewReader("1.0.0.0/24,1,high\n"), []string{"cidr", "ufi", "confidence"}); err == nil {
+		t.Errorf("expected error for bad confidence")
+	}
+}
+
+func TestValueTableBinary(t *testing.T) {
+	set := rangeSet{
+		v4: ipRangeList{
+			{0x01000000, 0x010000ff, 1},
+			{0x01000100, 0x010001ff, 0},
+		},
+		v6: ipRange6List{
+			{uint128{0x20010db8 << 32, 0}, uint128{0x20010db8 << 32, 0xffff}, 1},
+		},
+		table: valueTable{
+			{UFI: 100, Confidence: 0.5, Source: "survey", Label: "office"},
+			{UFI: 101},
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := writeBinary(&buf, set, binaryInfo{Created: time.Now(), Source: "test"}); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, info, err := readBinary(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded, set) {
+		t.Errorf("read %v, want %v", loaded, set)
+	}
+	if info.Values != 2 {
+		t.Errorf("info.Values=%d, want 2", info.Values)
+	}
+
+	tempFile, err := ioutil.TempFile("", "rgipValues")
+	if err != nil {
+		t.Fatalf("couldn't create temp file")
+	}
+	defer os.Remove(tempFile.Name())
+	tempFile.Write(buf.Bytes())
+	tempFile.Close()
+
+	m, err := openMmapRanges(tempFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	if !reflect.DeepEqual(m.values(), set.table) {
+		t.Errorf("mapped table %v, want %v", m.values(), set.table)
+	}
+	if data, ok := m.lookup6(uint128{0x20010db8 << 32, 1}); !ok || m.values().get(data).UFI != 101 {
+		t.Errorf("lookup6=(%d, %v), want UFI 101", data, ok)
+	}
+
+	// a corrupt table size must be rejected, not allocated
+	huge := append([]byte(nil), buf.Bytes()...)
+	binary.LittleEndian.PutUint32(huge[len(magicBytesV2)+4+8+4+len("test")+4+2*ipRangeSize+4+ipRange6Size:], 0xffffffff)
+	if _, _, err := readBinary(bytes.NewReader(huge)); err == nil {
+		t.Errorf("expected error for corrupted value table size")
+	}
+	if err := ioutil.WriteFile(tempFile.Name(), huge, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if m, err := openMmapRanges(tempFile.Name()); err == nil {
+		m.Close()
+		t.Errorf("expected error mapping corrupted value table size")
+	}
+}
+
+func TestValueTableGet(t *testing.T) {
+	var legacy valueTable
+	if v := legacy.get(42); v != (rangeValue{UFI: 42}) {
+		t.Errorf("nil table get(42)=%+v, want UFI 42", v)
+	}
+
+	table := valueTable{{UFI: 7}}
+	if v := table.get(3); v != (rangeValue{}) {
+		t.Errorf("get out of range=%+v, want zero value", v)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"os"
+	"time"
+
+	"github.com/dgryski/rgip/mlog"
+)
+
+// fileState is what the watcher saw of a data file
+type fileState struct {
+	exists bool
+	size   int64
+	mtime  time.Time
+}
+
+type fileStates map[string]fileState
+
+func statFiles(files []string) fileStates {
+	states := make(fileStates, len(files))
+	for _, f := range files {
+		fi, err := os.Stat(f)
+		if err != nil {
+			states[f] = fileState{}
+			continue
+		}
+		states[f] = fileState{exists: true, size: fi.Size(), mtime: fi.ModTime()}
+	}
+	return states
+}
+
+func (s fileStates) equal(o fileStates) bool {
+	if len(s) != len(o) {
+		return false
+	}
+	for f, st := range s {
+		ost, ok := o[f]
+		if !ok || st.exists != ost.exists || st.size != ost.size || !st.mtime.Equal(ost.mtime) {
+			return false
+		}
+	}
+	return true
+}
+
+// watcher polls data files for changes.  A change is only reported once the
+// files have stopped changing between two polls, so a reload doesn't start
+// while they're still being written.
+type watcher struct {
+	files   []string
+	loaded  fileStates // loaded is the state of the files at the last reload
+	pending fileStates // pending is the changed state seen at the previous poll
+}
+
+func newWatcher(files []string) *watcher {
+	return &watcher{files: files, loaded: statFiles(files)}
+}
+
+// poll returns true if the files have changed since the last reload and
+// settled since the previous poll
+func (w *watcher) poll() bool {
+	states := statFiles(w.files)
+
+	if states.equal(w.loaded) {
+		w.pending = nil
+		return false
+	}
+
+	if !states.equal(w.pending) {
+		for _, f := range w.files {
+			if old, st := w.loaded[f], states[f]; old != st && (w.pending == nil || w.pending[f] != st) {
+				mlog.Printf("data file %s changed (size %d, modified %s)", f, st.size, st.mtime.Format(time.RFC3339))
+			}
+		}
+		w.pending = states
+		return false
+	}
+
+	// the files are remembered even if the reload fails, so a bad file
+	// isn't retried until it changes again
+	w.loaded, w.pending = states, nil
+	return true
+}
+
+// run polls the files every interval, calling reload when they've changed
+func (w *watcher) run(interval time.Duration, reload func()) {
+	mlog.Printf("watching %d data files every %s", len(w.files), interval)
+	for range time.Tick(interval) {
+		if w.poll() {
+			reload()
+		}
+	}
+}
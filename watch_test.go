@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWatcherPoll(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rgipWatch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fname := filepath.Join(dir, "ufi.csv")
+	if err := ioutil.WriteFile(fname, []byte("16777215,1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	w := newWatcher([]string{fname, filepath.Join(dir, "missing.dat")})
+	if w.poll() {
+		t.Fatalf("reload requested for unchanged files")
+	}
+
+	// a file being written is left until it stops changing
+	f, err := os.OpenFile(fname, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("16777471,2\n")
+	if w.poll() {
+		t.Errorf("reload requested while the file is changing")
+	}
+	f.WriteString("16777727,3\n")
+	f.Close()
+	if w.poll() {
+		t.Errorf("reload requested while the file is changing")
+	}
+
+	if !w.poll() {
+		t.Errorf("no reload requested once the file settled")
+	}
+	if w.poll() {
+		t.Errorf("reload requested again for the same change")
+	}
+
+	os.Remove(fname)
+	if w.poll() || !w.poll() {
+		t.Errorf("expected a reload once the removal settled")
+	}
+}
+
+func TestDataConfigFiles(t *testing.T) {
+	config := dataConfig{Lite: true, DataDir: "/data", Data2Dir: "/data2", UFI: "ufi.bin"}
+	want := []string{"/data/GeoLiteCity.dat", "/data2/GeoLite2-City.mmdb", "ufi.bin"}
+	got := config.files()
+	if len(got) != len(want) {
+		t.Fatalf("files()=%q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("files()=%q, want %q", got, want)
+		}
+	}
+}